@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fancl20/bodman/manager"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+func newCommitCommand() *cli.Command {
+	return &cli.Command{
+		Name:     "commit",
+		HideHelp: true,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name: "help",
+			},
+			&cli.StringSliceFlag{
+				Name:    "change",
+				Aliases: []string{"c"},
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			args := ctx.Args()
+			if args.Len() != 2 {
+				return fmt.Errorf("Exactly two arguments expected")
+			}
+			m := manager.GetManager(ctx)
+			container, err := m.ContainerGet(args.Get(0))
+			if err != nil {
+				return err
+			}
+			img, err := loadImage(container.Dir())
+			if err != nil {
+				return fmt.Errorf("Load image config failed: %w", err)
+			}
+			for _, c := range ctx.StringSlice("change") {
+				if err := applyChange(&img.Config, c); err != nil {
+					return fmt.Errorf("Apply change %q failed: %w", c, err)
+				}
+			}
+			now := time.Now().UTC()
+			img.Created = &now
+			img.History = append(img.History, v1.History{
+				Created:   &now,
+				CreatedBy: fmt.Sprintf("bodman commit %s", container.ID),
+			})
+
+			tempDir, err := ioutil.TempDir("", "bodman-*")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tempDir)
+			if err := dumpImage(filepath.Join(tempDir, "manifest.json"), img); err != nil {
+				return fmt.Errorf("Dump image config failed: %w", err)
+			}
+
+			// Only rootfs and manifest.json belong to the image, everything
+			// else in the container directory is runtime state.
+			files, err := ioutil.ReadDir(container.Dir())
+			if err != nil {
+				return err
+			}
+			var skip []string
+			for _, f := range files {
+				if f.Name() != "rootfs" && f.Name() != "manifest.json" {
+					skip = append(skip, f.Name())
+				}
+			}
+			return m.ImageCommit(args.Get(1), container.Dir(), manager.ImageCommitOptions{
+				Parent:   container.Commit,
+				Overlays: []string{tempDir},
+				Skip:     skip,
+			})
+		},
+	}
+}
+
+func dumpImage(path string, img *v1.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(img)
+}
+
+// applyChange applies a Dockerfile instruction to the image config. Only
+// instructions which don't touch the filesystem are supported.
+func applyChange(cfg *v1.ImageConfig, change string) error {
+	change = strings.TrimSpace(change)
+	splitChange := strings.SplitN(change, " ", 2)
+	if len(splitChange) != 2 {
+		splitChange = strings.SplitN(change, "=", 2)
+	}
+	if len(splitChange) != 2 || strings.TrimSpace(splitChange[1]) == "" {
+		return fmt.Errorf("change must be in the form of INSTRUCTION VALUE")
+	}
+	instruction, value := strings.ToUpper(splitChange[0]), strings.TrimSpace(splitChange[1])
+	switch instruction {
+	case "CMD":
+		cfg.Cmd = parseCommandForm(value)
+	case "ENTRYPOINT":
+		cfg.Entrypoint = parseCommandForm(value)
+	case "ENV":
+		kvs, err := parseKeyValues(value)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			cfg.Env = setEnv(cfg.Env, kv[0], kv[1])
+		}
+	case "LABEL":
+		kvs, err := parseKeyValues(value)
+		if err != nil {
+			return err
+		}
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		for _, kv := range kvs {
+			cfg.Labels[kv[0]] = kv[1]
+		}
+	case "EXPOSE":
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = make(map[string]struct{})
+		}
+		for _, p := range strings.Fields(value) {
+			if !strings.Contains(p, "/") {
+				p += "/tcp"
+			}
+			cfg.ExposedPorts[p] = struct{}{}
+		}
+	case "VOLUME":
+		var volumes []string
+		if err := json.Unmarshal([]byte(value), &volumes); err != nil {
+			volumes = strings.Fields(value)
+		}
+		if cfg.Volumes == nil {
+			cfg.Volumes = make(map[string]struct{})
+		}
+		for _, v := range volumes {
+			cfg.Volumes[v] = struct{}{}
+		}
+	case "USER":
+		cfg.User = value
+	case "WORKDIR":
+		if !filepath.IsAbs(value) {
+			value = filepath.Join("/", cfg.WorkingDir, value)
+		}
+		cfg.WorkingDir = value
+	case "STOPSIGNAL":
+		cfg.StopSignal = value
+	default:
+		return fmt.Errorf("unsupported instruction %s", instruction)
+	}
+	return nil
+}
+
+// parseCommandForm parses the exec form (JSON array) or the shell form of
+// CMD and ENTRYPOINT.
+func parseCommandForm(value string) []string {
+	var cmd []string
+	if err := json.Unmarshal([]byte(value), &cmd); err == nil {
+		return cmd
+	}
+	return []string{"/bin/sh", "-c", value}
+}
+
+// parseKeyValues parses both "KEY VALUE" and "KEY1=VALUE1 KEY2=VALUE2" forms
+// of ENV and LABEL.
+func parseKeyValues(value string) ([][2]string, error) {
+	first := strings.Fields(value)[0]
+	if !strings.Contains(first, "=") {
+		splitValue := strings.SplitN(value, " ", 2)
+		if len(splitValue) != 2 {
+			return nil, fmt.Errorf("%s must have a value", value)
+		}
+		return [][2]string{{splitValue[0], strings.TrimSpace(splitValue[1])}}, nil
+	}
+	var kvs [][2]string
+	for _, f := range strings.Fields(value) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%s is invalid, values must be in the form of KEY=VALUE", f)
+		}
+		kvs = append(kvs, [2]string{kv[0], strings.Trim(kv[1], `"`)})
+	}
+	return kvs, nil
+}
+
+func setEnv(env []string, key, value string) []string {
+	for i, e := range env {
+		if strings.SplitN(e, "=", 2)[0] == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestApplyChanges applies changes in order, the way repeated --change flags
+// are, on top of an existing image config.
+func TestApplyChanges(t *testing.T) {
+	cfg := v1.ImageConfig{
+		Env:          []string{"PATH=/usr/bin", "MODE=prod"},
+		Cmd:          []string{"/bin/sh"},
+		WorkingDir:   "/app",
+		Labels:       map[string]string{"maintainer": "ops"},
+		ExposedPorts: map[string]struct{}{"80/tcp": {}},
+	}
+	changes := []string{
+		`CMD ["nginx", "-g", "daemon off;"]`,
+		"entrypoint /docker-entrypoint.sh",
+		"ENV MODE debug",
+		`ENV HOTFIX=1 TICKET="OPS-12"`,
+		"LABEL patched=true",
+		"EXPOSE 443 53/udp",
+		`VOLUME ["/var/cache/nginx"]`,
+		"VOLUME /data /logs",
+		"WORKDIR html",
+		"USER=nginx",
+		"STOPSIGNAL SIGQUIT",
+	}
+	for _, c := range changes {
+		if err := applyChange(&cfg, c); err != nil {
+			t.Fatalf("applyChange(%q): %v", c, err)
+		}
+	}
+	want := v1.ImageConfig{
+		Env:          []string{"PATH=/usr/bin", "MODE=debug", "HOTFIX=1", "TICKET=OPS-12"},
+		Cmd:          []string{"nginx", "-g", "daemon off;"},
+		Entrypoint:   []string{"/bin/sh", "-c", "/docker-entrypoint.sh"},
+		WorkingDir:   "/app/html",
+		User:         "nginx",
+		StopSignal:   "SIGQUIT",
+		Labels:       map[string]string{"maintainer": "ops", "patched": "true"},
+		ExposedPorts: map[string]struct{}{"80/tcp": {}, "443/tcp": {}, "53/udp": {}},
+		Volumes:      map[string]struct{}{"/var/cache/nginx": {}, "/data": {}, "/logs": {}},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestApplyChangeInvalid(t *testing.T) {
+	for _, c := range []string{
+		"",
+		"CMD",
+		"CMD   ",
+		"ENV PATH",
+		"ENV A=1 B",
+		"LABEL =x",
+		"RUN apt-get install -y curl",
+		"COPY . /app",
+	} {
+		cfg := v1.ImageConfig{}
+		if err := applyChange(&cfg, c); err == nil {
+			t.Errorf("applyChange(%q) = %+v, want error", c, cfg)
+		}
+	}
+}
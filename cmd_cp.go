@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chrootarchive"
+	"github.com/fancl20/bodman/manager"
+	"github.com/urfave/cli/v2"
+)
+
+func newCopyCommand() *cli.Command {
+	return &cli.Command{
+		Name:     "cp",
+		HideHelp: true,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name: "help",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			args := ctx.Args()
+			if args.Len() != 2 {
+				return fmt.Errorf("Exactly two arguments expected")
+			}
+			m := manager.GetManager(ctx)
+			src, err := parseCopyPath(m, args.Get(0))
+			if err != nil {
+				return err
+			}
+			dst, err := parseCopyPath(m, args.Get(1))
+			if err != nil {
+				return err
+			}
+			if src.container == nil && dst.container == nil {
+				return fmt.Errorf("Either source or destination must be a container path")
+			}
+			if src.path == "-" && dst.path == "-" {
+				return fmt.Errorf("Source and destination can't both be streams")
+			}
+
+			if src.path == "-" {
+				return dst.extract(os.Stdin)
+			}
+			srcInfo, content, err := src.archive()
+			if err != nil {
+				return fmt.Errorf("Archive %s failed: %w", args.Get(0), err)
+			}
+			defer content.Close()
+			if dst.path == "-" {
+				_, err := io.Copy(os.Stdout, content)
+				return err
+			}
+			if err := dst.copyTo(content, srcInfo); err != nil {
+				return fmt.Errorf("Copy to %s failed: %w", args.Get(1), err)
+			}
+			return nil
+		},
+	}
+}
+
+// copyPath is one side of a copy, either a path on the host, a path inside a
+// container or "-" for a tar stream on stdin or stdout.
+type copyPath struct {
+	container *manager.Container
+	path      string
+}
+
+func parseCopyPath(m *manager.Manager, arg string) (*copyPath, error) {
+	if arg == "-" || filepath.IsAbs(arg) || strings.HasPrefix(arg, ".") {
+		return &copyPath{path: arg}, nil
+	}
+	splitArg := strings.SplitN(arg, ":", 2)
+	if len(splitArg) != 2 {
+		return &copyPath{path: arg}, nil
+	}
+	c, err := m.ContainerGet(splitArg[0])
+	if err != nil {
+		return nil, err
+	}
+	if splitArg[1] == "" {
+		return nil, fmt.Errorf("Empty path in %s", arg)
+	}
+	return &copyPath{container: c, path: splitArg[1]}, nil
+}
+
+// resolve returns the root directory to chroot into and the path on host.
+// Paths on host have no root.
+func (p *copyPath) resolve(followLink bool) (string, string, error) {
+	if p.container == nil {
+		return "", p.path, nil
+	}
+	root, path, err := p.container.ResolvePath(p.path, followLink)
+	if err != nil {
+		return "", "", err
+	}
+	if path == root {
+		// Copy the content of root instead of root itself.
+		return root, path + string(filepath.Separator) + ".", nil
+	}
+	return root, archive.PreserveTrailingDotOrSeparator(path, p.path), nil
+}
+
+func (p *copyPath) archive() (archive.CopyInfo, io.ReadCloser, error) {
+	root, path, err := p.resolve(false)
+	if err != nil {
+		return archive.CopyInfo{}, nil, err
+	}
+	info, err := archive.CopyInfoSourcePath(path, false)
+	if err != nil {
+		return archive.CopyInfo{}, nil, err
+	}
+	if root == "" {
+		content, err := archive.TarResource(info)
+		return info, content, err
+	}
+	dir, base := archive.SplitPathDirEntry(info.Path)
+	content, err := chrootarchive.Tar(dir, &archive.TarOptions{
+		Compression:      archive.Uncompressed,
+		IncludeFiles:     []string{base},
+		IncludeSourceDir: true,
+		RebaseNames: map[string]string{
+			base: info.RebaseName,
+		},
+	}, root)
+	return info, content, err
+}
+
+func (p *copyPath) copyTo(content io.Reader, srcInfo archive.CopyInfo) error {
+	root, path, err := p.resolve(true)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := archive.CopyInfoDestinationPath(path)
+	if err != nil {
+		return err
+	}
+	dstDir, copyArchive, err := archive.PrepareArchiveCopy(content, srcInfo, dstInfo)
+	if err != nil {
+		return err
+	}
+	defer copyArchive.Close()
+	return untar(copyArchive, dstDir, root)
+}
+
+func (p *copyPath) extract(content io.Reader) error {
+	root, path, err := p.resolve(true)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("Destination %s must be a directory", p.path)
+	}
+	return untar(content, path, root)
+}
+
+func untar(content io.Reader, dst, root string) error {
+	// Ownership in the archive is preserved.
+	options := &archive.TarOptions{
+		NoOverwriteDirNonDir: true,
+	}
+	if root == "" {
+		return archive.Untar(content, dst, options)
+	}
+	return chrootarchive.UntarWithRoot(content, dst, options, root)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/fancl20/bodman/manager"
+	"github.com/urfave/cli/v2"
+)
+
+func newDiffCommand() *cli.Command {
+	return &cli.Command{
+		Name:     "diff",
+		HideHelp: true,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name: "help",
+			},
+			&cli.StringFlag{
+				Name: "format",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			args := ctx.Args()
+			if args.Len() != 1 {
+				return fmt.Errorf("Exactly one arguments expected")
+			}
+			m := manager.GetManager(ctx)
+			container, err := m.ContainerGet(args.First())
+			if err != nil {
+				return err
+			}
+			changes, err := m.ContainerDiff(container)
+			if err != nil {
+				return err
+			}
+			switch ctx.String("format") {
+			case "":
+				for _, p := range changes.Added {
+					fmt.Println("A", p)
+				}
+				for _, p := range changes.Changed {
+					fmt.Println("C", p)
+				}
+				for _, p := range changes.Deleted {
+					fmt.Println("D", p)
+				}
+				return nil
+			case "json":
+				return json.NewEncoder(os.Stdout).Encode(changes)
+			default:
+				return fmt.Errorf("Unsupported format: %s", ctx.String("format"))
+			}
+		},
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fancl20/bodman/manager"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+)
+
+func newExportCommand() *cli.Command {
+	return &cli.Command{
+		Name:     "export",
+		HideHelp: true,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name: "help",
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			args := ctx.Args()
+			if args.Len() != 1 {
+				return fmt.Errorf("Exactly one arguments expected")
+			}
+			m := manager.GetManager(ctx)
+			container, err := m.ContainerGet(args.First())
+			if err != nil {
+				return err
+			}
+			var output io.Writer = os.Stdout
+			if path := ctx.String("output"); path != "" && path != "-" {
+				f, err := os.Create(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				output = f
+			} else if _, err := unix.IoctlGetTermios(int(os.Stdout.Fd()), unix.TCGETS); err == nil {
+				return fmt.Errorf("Refusing to write tarball to a terminal, use --output or redirect stdout")
+			}
+			return m.ContainerExport(container, output)
+		},
+	}
+}
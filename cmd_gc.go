@@ -15,19 +15,46 @@ func newGCCommand() *cli.Command {
 			&cli.BoolFlag{
 				Name: "help",
 			},
+			&cli.BoolFlag{
+				Name: "dry-run",
+			},
 		},
 		Action: func(ctx *cli.Context) error {
 			m := manager.GetManager(ctx)
-			_, errs, err := m.ContainerPrune()
+			dryRun := ctx.Bool("dry-run")
+			report := func(kind string, removed []string, errs []error) {
+				for _, e := range errs {
+					fmt.Println(e)
+				}
+				if !dryRun {
+					return
+				}
+				for _, r := range removed {
+					fmt.Printf("Would remove %s %s\n", kind, r)
+				}
+			}
+			removed, errs, err := m.ContainerPrune(dryRun)
+			if err != nil {
+				return err
+			}
+			report("container", removed, errs)
+			removed, errs, err = m.PodPrune(dryRun)
 			if err != nil {
 				return err
 			}
-			for _, e := range errs {
-				fmt.Println(e)
+			report("pod", removed, errs)
+			removed, errs, err = m.LeakPrune(dryRun, ctx.String("cni-config-dir"), ctx.StringSlice("cni-plugin-dir"))
+			if err != nil {
+				return err
 			}
-			if _, err := m.ImagePrune(); err != nil {
+			report("leaked", removed, errs)
+			out, err := m.ImagePrune(dryRun)
+			if err != nil {
 				return err
 			}
+			if dryRun && out != "" {
+				fmt.Println(out)
+			}
 			return nil
 		},
 	}
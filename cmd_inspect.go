@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fancl20/bodman/manager"
+	"github.com/fancl20/bodman/mount"
+	"github.com/fancl20/bodman/network"
+	"github.com/urfave/cli/v2"
+)
+
+type containerInspect struct {
+	ID       string
+	Name     string
+	Image    string
+	Commit   string
+	Config   *manager.ContainerConfig
+	Hostname string
+	Mounts   []*mount.Mount
+	Devices  []string
+	Sysctls  map[string]string
+	Ports    []network.PortMapping
+	Networks network.Networks
+}
+
+func newInspectCommand() *cli.Command {
+	return &cli.Command{
+		Name:     "inspect",
+		HideHelp: true,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name: "help",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			args := ctx.Args()
+			if args.Len() != 1 {
+				return fmt.Errorf("Exactly one arguments expected")
+			}
+			c, err := manager.GetManager(ctx).ContainerGet(args.First())
+			if err != nil {
+				return err
+			}
+			n, err := network.Load(filepath.Join(c.Dir(), "network.json"))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Load container network config failed: %w", err)
+			}
+			out, err := json.MarshalIndent(&containerInspect{
+				ID:       c.ID,
+				Name:     c.Name,
+				Image:    c.Image,
+				Commit:   c.Commit,
+				Config:   c.Config,
+				Hostname: c.Hostname,
+				Mounts:   c.Volumes,
+				Devices:  c.Devices,
+				Sysctls:  c.Sysctls,
+				Ports:    c.Ports,
+				Networks: n,
+			}, "", "    ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/fancl20/bodman/manager"
+	"github.com/fancl20/bodman/network"
+	"github.com/urfave/cli/v2"
+)
+
+func newNetworkCommand() *cli.Command {
+	return &cli.Command{
+		Name:     "network",
+		HideHelp: true,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name: "help",
+			},
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:     "check",
+				HideHelp: true,
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if args.Len() != 1 {
+						return fmt.Errorf("Exactly one arguments expected")
+					}
+					c, err := manager.GetManager(ctx).ContainerGet(args.First())
+					if err != nil {
+						return err
+					}
+					n, err := network.Load(filepath.Join(c.Dir(), "network.json"))
+					if err != nil {
+						return fmt.Errorf("Load container network config failed: %w", err)
+					}
+					errs, err := n.Check()
+					if err != nil {
+						return err
+					}
+					for _, e := range errs {
+						fmt.Println(e)
+					}
+					if len(errs) > 0 {
+						return fmt.Errorf("Network of container %s is broken", c.ID)
+					}
+					return nil
+				},
+			},
+			{
+				Name:     "create",
+				HideHelp: true,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name: "subnet",
+					},
+					&cli.StringFlag{
+						Name: "gateway",
+					},
+					&cli.BoolFlag{
+						Name: "ipv6",
+					},
+					&cli.BoolFlag{
+						Name: "internal",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if args.Len() != 1 {
+						return fmt.Errorf("Exactly one arguments expected")
+					}
+					opts := network.CreateOptions{
+						Gateway:  ctx.String("gateway"),
+						IPv6:     ctx.Bool("ipv6"),
+						Internal: ctx.Bool("internal"),
+					}
+					for _, s := range ctx.StringSlice("subnet") {
+						if isIPv6CIDR(s) {
+							opts.IPv6Subnet = s
+						} else {
+							opts.Subnet = s
+						}
+					}
+					path, err := network.CreateConfList(ctx.String("cni-config-dir"), args.First(), opts)
+					if err != nil {
+						return err
+					}
+					fmt.Println(path)
+					return nil
+				},
+			},
+			{
+				Name:     "inspect",
+				HideHelp: true,
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if args.Len() != 1 {
+						return fmt.Errorf("Exactly one arguments expected")
+					}
+					name := args.First()
+					users, err := networkUsers(ctx)
+					if err != nil {
+						return err
+					}
+					out := &networkInspect{
+						Name:       name,
+						Containers: users[name],
+					}
+					switch name {
+					case "host", "none":
+						out.Driver = name
+					case "bodman":
+						out.Driver = "bridge"
+						out.Subnet = network.BridgeSubnet(ctx.String("base-directory"))
+					default:
+						confs, err := network.ListConfLists(ctx.String("cni-config-dir"))
+						if err != nil {
+							return err
+						}
+						for _, c := range confs {
+							if c.Name == name {
+								out.Driver = "cni"
+								out.Path = c.Path
+								out.Config = json.RawMessage(c.Bytes)
+								break
+							}
+						}
+						if out.Driver == "" {
+							return fmt.Errorf("No such network: %s", name)
+						}
+					}
+					content, err := json.MarshalIndent(out, "", "    ")
+					if err != nil {
+						return err
+					}
+					fmt.Println(string(content))
+					return nil
+				},
+			},
+			{
+				Name:     "ls",
+				HideHelp: true,
+				Action: func(ctx *cli.Context) error {
+					confs, err := network.ListConfLists(ctx.String("cni-config-dir"))
+					if err != nil {
+						return err
+					}
+					users, err := networkUsers(ctx)
+					if err != nil {
+						return err
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(w, "NAME\tDRIVER\tCONTAINERS")
+					for _, name := range []string{"host", "none", "bodman"} {
+						fmt.Fprintf(w, "%s\t%s\t%d\n", name, "builtin", len(users[name]))
+					}
+					seen := make(map[string]bool)
+					for _, c := range confs {
+						// libcni uses the first config of a name.
+						if seen[c.Name] {
+							continue
+						}
+						if network.IsBuiltin(c.Name) {
+							fmt.Fprintf(os.Stderr, "Network config %s is shadowed by the built-in network %s\n", c.Path, c.Name)
+							continue
+						}
+						seen[c.Name] = true
+						fmt.Fprintf(w, "%s\t%s\t%d\n", c.Name, "cni", len(users[c.Name]))
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:     "rm",
+				HideHelp: true,
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if args.Len() != 1 {
+						return fmt.Errorf("Exactly one arguments expected")
+					}
+					users, err := networkUsers(ctx)
+					if err != nil {
+						return err
+					}
+					if ids := users[args.First()]; len(ids) > 0 {
+						return fmt.Errorf("Network %s is used by running containers: %v", args.First(), ids)
+					}
+					return network.RemoveConfList(ctx.String("cni-config-dir"), args.First())
+				},
+			},
+		},
+	}
+}
+
+type networkInspect struct {
+	Name       string
+	Driver     string
+	Path       string          `json:",omitempty"`
+	Subnet     string          `json:",omitempty"`
+	Config     json.RawMessage `json:",omitempty"`
+	Containers []string
+}
+
+// networkUsers returns IDs of running containers by the network they use.
+func networkUsers(ctx *cli.Context) (map[string][]string, error) {
+	containers, err := manager.GetManager(ctx).ContainerList()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := manager.GetManager(ctx).PodList()
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]string)
+	for _, p := range pods {
+		for _, name := range p.Networks.Names() {
+			users[name] = append(users[name], "pod:"+p.Name)
+		}
+	}
+	for _, c := range containers {
+		running, err := c.Running()
+		if err != nil || !running {
+			continue
+		}
+		n, err := network.Load(filepath.Join(c.Dir(), "network.json"))
+		if err != nil {
+			continue
+		}
+		for _, name := range n.Names() {
+			users[name] = append(users[name], c.ID)
+		}
+	}
+	return users, nil
+}
+
+func isIPv6CIDR(s string) bool {
+	_, n, err := net.ParseCIDR(s)
+	return err == nil && n.IP.To4() == nil
+}
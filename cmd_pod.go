@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fancl20/bodman/manager"
+	"github.com/fancl20/bodman/network"
+	"github.com/urfave/cli/v2"
+)
+
+func newPodCommand() *cli.Command {
+	return &cli.Command{
+		Name:     "pod",
+		HideHelp: true,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name: "help",
+			},
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:     "create",
+				HideHelp: true,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name: "egress-burst",
+					},
+					&cli.StringFlag{
+						Name: "egress-rate",
+					},
+					&cli.StringFlag{
+						Name:    "hostname",
+						Aliases: []string{"h"},
+					},
+					&cli.StringFlag{
+						Name: "infiniband-guid",
+					},
+					&cli.StringFlag{
+						Name: "ingress-burst",
+					},
+					&cli.StringFlag{
+						Name: "ingress-rate",
+					},
+					&cli.StringFlag{
+						Name: "ip",
+					},
+					&cli.StringSliceFlag{
+						Name: "ip-range",
+					},
+					&cli.StringFlag{
+						Name: "ip6",
+					},
+					&cli.StringFlag{
+						Name: "mac-address",
+					},
+					&cli.StringSliceFlag{
+						Name:    "network",
+						Aliases: []string{"net"},
+						Value:   cli.NewStringSlice("bodman"),
+					},
+					&cli.StringSliceFlag{
+						Name:    "network-alias",
+						Aliases: []string{"net-alias"},
+					},
+					&cli.StringSliceFlag{
+						Name: "network-opt",
+					},
+					&cli.StringSliceFlag{
+						Name:    "publish",
+						Aliases: []string{"p"},
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if args.Len() != 1 {
+						return fmt.Errorf("Exactly one arguments expected")
+					}
+					name := args.First()
+					hostname := stringDefault(ctx.String("hostname"), name)
+					m := manager.GetManager(ctx)
+					p, err := m.PodCreate(name, hostname, ctx.StringSlice("network-alias"), func(id, cacheDir string) (network.Networks, error) {
+						networks, err := network.NewNetworks(ctx, hostname, id, cacheDir, nil)
+						if err != nil {
+							return nil, err
+						}
+						// Pods have no process to keep a port forwarder alive.
+						if len(networks[0].PortMappings) > 0 {
+							if needed, err := networks[0].NeedsPortForwarder(); err != nil {
+								return nil, err
+							} else if needed {
+								return nil, fmt.Errorf("Network %s can't publish ports of pods", networks[0].NetworkName)
+							}
+						}
+						if name := networks[0].JoinedContainer(); name != "" {
+							if networks[0].NamespacePath, err = containerNetNS(m, name); err != nil {
+								return nil, err
+							}
+						}
+						return networks, nil
+					})
+					if err != nil {
+						return err
+					}
+					fmt.Println(p.ID)
+					return nil
+				},
+			},
+			{
+				Name:     "ps",
+				HideHelp: true,
+				Action: func(ctx *cli.Context) error {
+					m := manager.GetManager(ctx)
+					pods, err := m.PodList()
+					if err != nil {
+						return err
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(w, "NAME\tID\tNETWORKS\tCONTAINERS")
+					for _, p := range pods {
+						members, err := m.PodMembers(p)
+						if err != nil {
+							return err
+						}
+						fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", p.Name, p.ID, strings.Join(p.Networks.Names(), ","), len(members))
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:     "rm",
+				HideHelp: true,
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if args.Len() != 1 {
+						return fmt.Errorf("Exactly one arguments expected")
+					}
+					m := manager.GetManager(ctx)
+					p, err := m.PodGet(args.First())
+					if err != nil {
+						return err
+					}
+					errs := m.PodRemove(p)
+					for _, e := range errs {
+						fmt.Println(e)
+					}
+					if len(errs) > 0 {
+						return fmt.Errorf("Remove pod %s failed", p.Name)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fancl20/bodman/manager"
+	"github.com/urfave/cli/v2"
+)
+
+func newPortCommand() *cli.Command {
+	return &cli.Command{
+		Name:     "port",
+		HideHelp: true,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name: "help",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			args := ctx.Args()
+			if args.Len() != 1 && args.Len() != 2 {
+				return fmt.Errorf("Container and an optional PORT[/PROTO] expected")
+			}
+			c, err := manager.GetManager(ctx).ContainerGet(args.First())
+			if err != nil {
+				return err
+			}
+			var port int
+			proto := ""
+			if args.Len() == 2 {
+				splitPort := strings.SplitN(args.Get(1), "/", 2)
+				if port, err = strconv.Atoi(splitPort[0]); err != nil {
+					return fmt.Errorf("Invalid port %s: %w", args.Get(1), err)
+				}
+				if len(splitPort) == 2 {
+					proto = strings.ToLower(splitPort[1])
+				}
+			}
+			found := false
+			for _, p := range c.Ports {
+				if port != 0 && int(p.ContainerPort) != port {
+					continue
+				}
+				if proto != "" && p.Protocol != proto {
+					continue
+				}
+				fmt.Println(p)
+				found = true
+			}
+			if port != 0 && !found {
+				return fmt.Errorf("No public port %s published for %s", args.Get(1), c.ID)
+			}
+			return nil
+		},
+	}
+}
@@ -77,7 +77,7 @@ func newPullCommand() *cli.Command {
 			}
 
 			// Commit image
-			if err := manager.GetManager(ctx).ImageCommit(args.First(), buildDir); err != nil {
+			if err := manager.GetManager(ctx).ImageCommit(args.First(), buildDir, manager.ImageCommitOptions{}); err != nil {
 				return err
 			}
 			return nil
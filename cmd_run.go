@@ -5,19 +5,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
-	"os/user"
 	"path/filepath"
-	"strconv"
 	"strings"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/fancl20/bodman/devices"
 	"github.com/fancl20/bodman/manager"
 	"github.com/fancl20/bodman/network"
 	"github.com/google/uuid"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli/v2"
+	"github.com/vishvananda/netns"
 )
 
 func newRunCommand() *cli.Command {
@@ -29,8 +30,10 @@ func newRunCommand() *cli.Command {
 				Name: "help",
 			},
 			&cli.StringSliceFlag{
-				Name:  "dns",
-				Value: cli.NewStringSlice("8.8.8.8"),
+				Name: "add-host",
+			},
+			&cli.StringSliceFlag{
+				Name: "dns",
 			},
 			&cli.StringSliceFlag{
 				Name:    "dns-option",
@@ -39,29 +42,85 @@ func newRunCommand() *cli.Command {
 			&cli.StringSliceFlag{
 				Name: "dns-search",
 			},
+			&cli.StringFlag{
+				Name: "egress-burst",
+			},
+			&cli.StringFlag{
+				Name: "egress-rate",
+			},
 			&cli.StringSliceFlag{
 				Name:    "env",
 				Aliases: []string{"e"},
 			},
+			&cli.StringSliceFlag{
+				Name: "env-file",
+			},
+			&cli.StringSliceFlag{
+				Name: "group-add",
+			},
 			&cli.StringFlag{
 				Name:    "hostname",
 				Aliases: []string{"h"},
 			},
 			&cli.StringFlag{
+				Name: "infiniband-guid",
+			},
+			&cli.StringFlag{
+				Name: "ingress-burst",
+			},
+			&cli.StringFlag{
+				Name: "ingress-rate",
+			},
+			&cli.StringFlag{
+				Name: "ip",
+			},
+			&cli.StringSliceFlag{
+				Name: "ip-range",
+			},
+			&cli.StringFlag{
+				Name: "ip6",
+			},
+			&cli.StringFlag{
+				Name: "mac-address",
+			},
+			&cli.StringFlag{
+				Name: "name",
+			},
+			&cli.BoolFlag{
+				Name: "no-hosts",
+			},
+			&cli.StringSliceFlag{
 				Name:    "network",
 				Aliases: []string{"net"},
-				Value:   "host",
+				Value:   cli.NewStringSlice("host"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "network-alias",
+				Aliases: []string{"net-alias"},
+			},
+			&cli.StringSliceFlag{
+				Name: "network-opt",
 			},
 			&cli.StringSliceFlag{
 				Name:    "publish",
 				Aliases: []string{"p"},
 			},
+			&cli.StringFlag{
+				Name: "pod",
+			},
+			&cli.BoolFlag{
+				Name:    "publish-all",
+				Aliases: []string{"P"},
+			},
 			&cli.StringSliceFlag{
 				Name: "sysctl",
 			},
 			&cli.BoolFlag{
 				Name: "systemd-activation",
 			},
+			&cli.StringSliceFlag{
+				Name: "unsetenv",
+			},
 			&cli.StringFlag{
 				Name:    "user",
 				Aliases: []string{"u"},
@@ -75,86 +134,295 @@ func newRunCommand() *cli.Command {
 				Aliases: []string{"w"},
 			},
 		},
-		Action: func(ctx *cli.Context) error {
+		Action: func(ctx *cli.Context) (err error) {
 			args := ctx.Args()
 			containerID := uuid.New().String()
-			containerDir, lock, err := manager.GetManager(ctx).ImageCheckout(args.First(), containerID)
+			container, lock, err := manager.GetManager(ctx).ImageCheckout(args.First(), containerID, ctx.String("name"))
 			if err != nil {
 				return err
 			}
+			containerDir := container.Dir()
 			// The lock won't be closed if we successfully call exec. This is
 			// an intended behaviour so the container directory will be locked
 			// until process exit.
 			defer lock.Close()
 
+			// Every step below registers how to revert itself, so a failed
+			// run leaves nothing behind.
+			var undo undoStack
+			defer func() {
+				if err != nil {
+					undo.rollback()
+				}
+			}()
+			undo.push(func() error {
+				if err := os.RemoveAll(containerDir); err != nil {
+					return fmt.Errorf("Remove container dir failed: %w", err)
+				}
+				return nil
+			})
+
 			cfg, err := loadImageConfig(containerDir)
 			if err != nil {
 				return err
 			}
 
 			hostname := stringDefault(ctx.String("hostname"), strings.Split(containerID, "-")[0])
+			var pod *manager.Pod
+			if name := ctx.String("pod"); name != "" {
+				for _, flag := range []string{"egress-burst", "egress-rate", "hostname", "infiniband-guid", "ingress-burst", "ingress-rate", "ip", "ip-range", "ip6", "mac-address", "network", "network-alias", "network-opt", "publish", "publish-all"} {
+					if ctx.IsSet(flag) {
+						return fmt.Errorf("--%s can't be used with --pod, set it on the pod instead", flag)
+					}
+				}
+				if pod, err = manager.GetManager(ctx).PodGet(name); err != nil {
+					return err
+				}
+				first, err := manager.GetManager(ctx).PodJoin(pod, container)
+				if err != nil {
+					return err
+				}
+				undo.push(func() error { return manager.GetManager(ctx).PodLeave(pod, container, first) })
+				hostname = pod.Hostname
+			}
 
-			networkConfig, err := network.NewNetwork(ctx, hostname, containerID)
+			volumes, err := parseVolumes(ctx)
+			if err != nil {
+				return fmt.Errorf("Parse mounts failed: %w", err)
+			}
+			sysctls, err := validateSysctls(ctx.StringSlice("sysctl"))
+			if err != nil {
+				return fmt.Errorf("Validate sysctls failed: %w", err)
+			}
+			extraHosts, err := parseAddHosts(ctx.StringSlice("add-host"))
+			if err != nil {
+				return err
+			}
+			devs, err := devices.HostDevices()
 			if err != nil {
+				return fmt.Errorf("List host devices failed: %w", err)
+			}
+
+			cmd := stringSliceDefault(args.Tail(), cfg.Cmd)
+			execArgs := append(cfg.Entrypoint, cmd...)
+			if len(execArgs) == 0 {
+				return fmt.Errorf("Empty exec args provided")
+			}
+			env, err := buildEnv(ctx, cfg.Env)
+			if err != nil {
+				return err
+			}
+			cwd := stringDefault(ctx.String("workdir"), cfg.WorkingDir, "/")
+			rawUser := stringDefault(ctx.String("user"), cfg.User)
+
+			var networks network.Networks
+			if pod != nil {
+				path, err := pod.Networks.NamespacePath()
+				if err != nil {
+					return err
+				}
+				networks = network.NewPodNetworks(pod.Name, path)
+			} else if networks, err = network.NewNetworks(ctx, hostname, containerID, filepath.Join(containerDir, "cni"), cfg.ExposedPorts); err != nil {
 				return fmt.Errorf("Create network config failed: %w", err)
 			}
+			if name := networks[0].JoinedContainer(); name != "" {
+				if networks[0].NamespacePath, err = containerNetNS(manager.GetManager(ctx), name); err != nil {
+					return err
+				}
+			}
 			networkConfigPath := filepath.Join(containerDir, "network.json")
-			if err := network.Dump(networkConfigPath, networkConfig); err != nil {
+			if err := network.Dump(networkConfigPath, networks); err != nil {
 				return fmt.Errorf("Dump network config failed: %w", err)
 			}
 
-			if err := unix.Unshare(unix.CLONE_NEWIPC | unix.CLONE_NEWNS | unix.CLONE_NEWUTS); err != nil {
-				return fmt.Errorf("Unshare namespaces failed: %w", err)
+			// The host filesystem is unreachable after pivot root, keep the
+			// mount and network namespaces to go back to for rollback.
+			hostMntNS, err := unix.Open("/proc/self/ns/mnt", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return fmt.Errorf("Open mount namespace failed: %w", err)
+			}
+			undo.push(func() error { return unix.Close(hostMntNS) })
+			hostNetNS, err := netns.Get()
+			if err != nil {
+				return fmt.Errorf("Get network namespace failed: %w", err)
+			}
+			undo.push(hostNetNS.Close)
+
+			// The forwarder is started before unsharing to stay in the host
+			// namespaces.
+			var forwarder *network.PortForwarder
+			if needed, err := networks[0].NeedsPortForwarder(); err != nil {
+				return err
+			} else if needed {
+				if forwarder, err = network.StartPortForwarder(); err != nil {
+					return err
+				}
+				undo.push(forwarder.Stop)
+			}
+
+			if pod == nil {
+				if err := unix.Unshare(unix.CLONE_NEWIPC | unix.CLONE_NEWNS | unix.CLONE_NEWUTS); err != nil {
+					return fmt.Errorf("Unshare namespaces failed: %w", err)
+				}
+			} else {
+				if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+					return fmt.Errorf("Unshare namespaces failed: %w", err)
+				}
+				if err := joinNamespace(pod.IPCNamespace, unix.CLONE_NEWIPC); err != nil {
+					return err
+				}
+				if err := joinNamespace(pod.UTSNamespace, unix.CLONE_NEWUTS); err != nil {
+					return err
+				}
 			}
-			if err := networkConfig.Execute(); err != nil {
+			// Registered before Execute since a failed Execute may still
+			// leave the netns or a partial CNI attachment behind.
+			undo.push(func() error {
+				if err := netns.Set(hostNetNS); err != nil {
+					return fmt.Errorf("Back to host netns failed: %w", err)
+				}
+				if errs := networks.Remove(); len(errs) > 0 {
+					return fmt.Errorf("Remove network failed: %v", errs)
+				}
+				return nil
+			})
+			if err := networks.Execute(); err != nil {
 				return fmt.Errorf("Execute network config failed: %w", err)
 			}
+			if err := network.Dump(networkConfigPath, networks); err != nil {
+				return fmt.Errorf("Dump network config failed: %w", err)
+			}
+			if forwarder != nil {
+				ip := networks[0].ContainerIP()
+				if ip == nil {
+					return fmt.Errorf("Network %s assigned no address to forward ports to", networks[0].NetworkName)
+				}
+				if err := forwarder.Forward(ip, networks[0].PortMappings); err != nil {
+					return err
+				}
+			}
 
-			rootfs := filepath.Join(containerDir, "rootfs")
-			mounts, err := parseMounts(ctx)
+			// The host resolv.conf is unreachable after pivot root.
+			dnsNetworks := networks
+			if pod != nil {
+				dnsNetworks = pod.Networks
+			}
+			hostIP := dnsNetworks[0].ContainerIP()
+			dns, err := containerResolvConf(ctx, dnsNetworks, hostNetNS)
 			if err != nil {
-				return fmt.Errorf("Parse mounts failed: %w", err)
+				return fmt.Errorf("Load dns config failed: %w", err)
+			}
+
+			// The hosts file is written from the host, since the registry
+			// updates it while the container runs.
+			var hostsRootfs string
+			if !ctx.Bool("no-hosts") {
+				hostsRootfs = container.Rootfs()
+				hostsFile, err := network.ResolveHostsFile(hostsRootfs)
+				if err != nil {
+					return fmt.Errorf("Set hosts failed: %w", err)
+				}
+				if err := buildHosts(hostsFile, hostname, hostIP, extraHosts); err != nil {
+					return fmt.Errorf("Set hosts failed: %w", err)
+				}
 			}
-			if err := prepareRootfs(rootfs, mounts); err != nil {
+			hostNames := []string{hostname}
+			if container.Name != "" && container.Name != hostname {
+				hostNames = append([]string{container.Name}, hostNames...)
+			}
+			if pod != nil {
+				hostNames = append(hostNames, pod.Aliases...)
+			} else {
+				hostNames = append(hostNames, ctx.StringSlice("network-alias")...)
+			}
+			if err := network.RegisterHosts(ctx.String("base-directory"), containerID, hostNames, hostsRootfs, containerDir, dnsNetworks); err != nil {
+				return err
+			}
+			undo.push(func() error {
+				return network.UnregisterHosts(ctx.String("base-directory"), containerID)
+			})
+
+			// The container directory is unreachable after pivot root, so
+			// the state must be saved before preparing rootfs.
+			container.Hostname = hostname
+			container.Config = &manager.ContainerConfig{
+				Cmd:        execArgs,
+				Env:        env,
+				User:       rawUser,
+				WorkingDir: cwd,
+			}
+			container.Volumes = volumes
+			container.Devices = nil
+			for _, d := range devs {
+				if d.Major != 0 {
+					container.Devices = append(container.Devices, d.Path)
+				}
+			}
+			container.Sysctls = sysctls
+			container.Ports = networks[0].PortMappings
+			if pod != nil {
+				// Members are reached through the ports the pod publishes.
+				container.Ports = pod.Networks[0].PortMappings
+			}
+			if err := container.Save(); err != nil {
+				return fmt.Errorf("Save container state failed: %w", err)
+			}
+
+			// Everything undone before this runs on host paths, which
+			// would resolve inside the container rootfs if it failed.
+			undo.push(func() error {
+				if err := unix.Setns(hostMntNS, unix.CLONE_NEWNS); err != nil {
+					return fmt.Errorf("Back to host mount namespace failed: %v: %w", err, errAbortRollback)
+				}
+				return nil
+			})
+			rootfs := filepath.Join(containerDir, "rootfs")
+			mounts := append(defaultMounts(), volumes...)
+			if err := prepareRootfs(rootfs, mounts, devs); err != nil {
 				return fmt.Errorf("Move root failed: %w", err)
 			}
 
-			if err := addSysctls(ctx); err != nil {
+			if err := addSysctls(ctx, sysctls); err != nil {
 				return fmt.Errorf("Add sysctls failed: %w", err)
 			}
 
-			cwd := stringDefault(ctx.String("workdir"), cfg.WorkingDir, "/")
 			if err := unix.Chdir(cwd); err != nil {
 				return fmt.Errorf("Chdir failed: %w", err)
 			}
 
-			if err := buildDNSResolve("/etc/resolv.conf", ctx.StringSlice("dns"), ctx.StringSlice("dns-search"), ctx.StringSlice("dns-option")); err != nil {
-				return fmt.Errorf("Set dns failed: %w", err)
+			if dns != nil {
+				if err := buildDNSResolve("/etc/resolv.conf", dns.Nameservers, dns.Search, dns.Options); err != nil {
+					return fmt.Errorf("Set dns failed: %w", err)
+				}
 			}
-
-			if err := unix.Sethostname([]byte(hostname)); err != nil {
-				return fmt.Errorf("Sethostname failed: %w", err)
+			if !ctx.Bool("no-hosts") {
+				if err := writeContainerFile("/etc/hostname", []byte(hostname+"\n")); err != nil {
+					return fmt.Errorf("Set hostname file failed: %w", err)
+				}
 			}
 
-			rawUser := stringDefault(ctx.String("user"), cfg.User)
-			if rawUser != "" {
-				uid, err := parseUser(rawUser)
-				if err != nil {
-					return err
+			// Pods share the UTS namespace, whose hostname is set on create.
+			if pod == nil {
+				if err := unix.Sethostname([]byte(hostname)); err != nil {
+					return fmt.Errorf("Sethostname failed: %w", err)
 				}
-				unix.Setuid(uid)
 			}
 
-			cmd := stringSliceDefault(args.Tail(), cfg.Cmd)
-			execArgs := append(cfg.Entrypoint, cmd...)
-			if len(execArgs) == 0 {
-				return fmt.Errorf("Empty exec args provided")
+			execUser, err := resolveUser(rawUser, ctx.StringSlice("group-add"), "/etc/passwd", "/etc/group")
+			if err != nil {
+				return fmt.Errorf("Resolve user failed: %w", err)
 			}
-			env := append(ctx.StringSlice("env"), cfg.Env...)
+			env = append(env, execUser.Env(env)...)
+
 			executable, err := lookPath(execArgs[0], env)
 			if err != nil {
 				return err
 			}
+
+			// Rollback needs privileges, so drop them as late as possible.
+			if err := execUser.Apply(); err != nil {
+				return err
+			}
 			if ctx.Bool("systemd-activation") {
 				env = append(env, bypassSystemdActivation()...)
 			}
@@ -167,7 +435,7 @@ func newRunCommand() *cli.Command {
 	}
 }
 
-func loadImageConfig(containerDir string) (*v1.ImageConfig, error) {
+func loadImage(containerDir string) (*v1.Image, error) {
 	f, err := os.Open(filepath.Join(containerDir, "manifest.json"))
 	if err != nil {
 		return nil, err
@@ -177,9 +445,50 @@ func loadImageConfig(containerDir string) (*v1.ImageConfig, error) {
 	if err := json.NewDecoder(f).Decode(&img); err != nil {
 		return nil, err
 	}
+	return &img, nil
+}
+
+func loadImageConfig(containerDir string) (*v1.ImageConfig, error) {
+	img, err := loadImage(containerDir)
+	if err != nil {
+		return nil, err
+	}
 	return &img.Config, nil
 }
 
+// containerNetNS returns the path of the network namespace of a running
+// container.
+func containerNetNS(m *manager.Manager, name string) (string, error) {
+	c, err := m.ContainerGet(name)
+	if err != nil {
+		return "", err
+	}
+	running, err := c.Running()
+	if err != nil {
+		return "", err
+	}
+	if !running {
+		return "", fmt.Errorf("Container %s is not running", c.ID)
+	}
+	networks, err := network.Load(filepath.Join(c.Dir(), "network.json"))
+	if err != nil {
+		return "", fmt.Errorf("Load network config of %s failed: %w", c.ID, err)
+	}
+	return networks.NamespacePath()
+}
+
+func joinNamespace(path string, nstype int) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Open namespace %s failed: %w", path, err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Setns(fd, nstype); err != nil {
+		return fmt.Errorf("Join namespace %s failed: %w", path, err)
+	}
+	return nil
+}
+
 func stringDefault(ss ...string) string {
 	for _, s := range ss {
 		if s != "" {
@@ -198,18 +507,6 @@ func stringSliceDefault(ss ...[]string) []string {
 	return []string{}
 }
 
-func parseUser(s string) (int, error) {
-	u, err := user.Lookup(s)
-	if err == nil {
-		s = u.Uid
-	}
-	uid, err := strconv.ParseInt(s, 10, 32)
-	if err != nil {
-		return 0, fmt.Errorf("Invalid User: %v", s)
-	}
-	return int(uid), nil
-}
-
 func findExecutable(file string) error {
 	d, err := os.Stat(file)
 	if err != nil {
@@ -278,7 +575,47 @@ func buildDNSResolve(path string, dns, dnsSearch, dnsOptions []string) error {
 			}
 		}
 	}
-	return ioutil.WriteFile(path, content.Bytes(), 0644)
+	return writeContainerFile(path, content.Bytes())
+}
+
+// parseAddHosts parses --add-host in the form of NAME:IP into hosts file
+// lines.
+func parseAddHosts(hosts []string) ([]string, error) {
+	var lines []string
+	for _, h := range hosts {
+		arr := strings.SplitN(h, ":", 2)
+		if len(arr) != 2 || arr[0] == "" || net.ParseIP(arr[1]) == nil {
+			return nil, fmt.Errorf("%s is invalid, extra hosts must be in the form of NAME:IP", h)
+		}
+		lines = append(lines, arr[1]+"\t"+arr[0])
+	}
+	return lines, nil
+}
+
+// buildHosts writes the hosts file. The hostname is mapped to 127.0.1.1 if
+// the container has no address of its own, like on the host network.
+func buildHosts(path, hostname string, ip net.IP, extraHosts []string) error {
+	content := bytes.NewBuffer(nil)
+	content.WriteString("127.0.0.1\tlocalhost\n")
+	content.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	if ip != nil {
+		content.WriteString(ip.String() + "\t" + hostname + "\n")
+	} else {
+		content.WriteString("127.0.1.1\t" + hostname + "\n")
+	}
+	for _, line := range extraHosts {
+		content.WriteString(line + "\n")
+	}
+	return writeContainerFile(path, content.Bytes())
+}
+
+// writeContainerFile replaces a file of the rootfs. Files of the rootfs are
+// hard links to the image, so they are never written in place.
+func writeContainerFile(path string, content []byte) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
 }
 
 func validateSysctls(strSlice []string) (map[string]string, error) {
@@ -323,18 +660,14 @@ func validateSysctls(strSlice []string) (map[string]string, error) {
 	return sysctl, nil
 }
 
-func addSysctls(ctx *cli.Context) error {
-	ctls, err := validateSysctls(ctx.StringSlice("sysctl"))
-	if err != nil {
-		return err
-	}
+func addSysctls(ctx *cli.Context, ctls map[string]string) error {
 	for sysctlKey, sysctlVal := range ctls {
 		// Ignore mqueue sysctls if --ipc=host
 		if ctx.String("ipc") == "host" && strings.HasPrefix(sysctlKey, "fs.mqueue.") {
 			return fmt.Errorf("Sysctl %s=%s ignored in containers.conf, since IPC Namespace set to host", sysctlKey, sysctlVal)
 		}
 		// Ignore net sysctls if --net=host
-		if ctx.String("network") == "host" && strings.HasPrefix(sysctlKey, "net.") {
+		if networks := network.SplitNetworks(ctx.StringSlice("network")); ctx.String("pod") == "" && len(networks) == 1 && networks[0] == "host" && strings.HasPrefix(sysctlKey, "net.") {
 			return fmt.Errorf("Sysctl %s=%s ignored in containers.conf, since Network Namespace set to host", sysctlKey, sysctlVal)
 		}
 		// Ignore uts sysctls if --uts=host
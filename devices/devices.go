@@ -109,11 +109,9 @@ func GetDevices(path string) ([]*Device, error) {
 	return out, nil
 }
 
-func CreateDevicesFromHost(rootfs string) error {
-	devices, err := GetDevices("/dev")
-	if err != nil {
-		return err
-	}
+// CreateDevices creates device nodes in rootfs. Devices without a major number
+// are skipped.
+func CreateDevices(rootfs string, devices []*Device) error {
 	for _, node := range devices {
 		if node.Major == 0 {
 			continue
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// defaultPath is used when the image doesn't set PATH, same as docker.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// buildEnv merges the environment of the image with the flags. Later sources
+// win: the image, --unsetenv, --env-file, then --env.
+func buildEnv(ctx *cli.Context, imageEnv []string) ([]string, error) {
+	env := append([]string{}, imageEnv...)
+	if _, ok := lookupEnv(env, "PATH"); !ok {
+		env = setEnv(env, "PATH", defaultPath)
+	}
+	for _, key := range ctx.StringSlice("unsetenv") {
+		env = unsetEnv(env, key)
+	}
+	for _, path := range ctx.StringSlice("env-file") {
+		entries, err := parseEnvFile(path, env)
+		if err != nil {
+			return nil, fmt.Errorf("Parse env file %s failed: %w", path, err)
+		}
+		for _, e := range entries {
+			if env, err = applyEnv(env, e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, e := range ctx.StringSlice("env") {
+		var err error
+		if env, err = applyEnv(env, e); err != nil {
+			return nil, err
+		}
+	}
+	return env, nil
+}
+
+// applyEnv sets KEY=VALUE in env. A KEY without value is taken from the
+// host, and skipped if the host doesn't define it.
+func applyEnv(env []string, e string) ([]string, error) {
+	arr := strings.SplitN(e, "=", 2)
+	key := arr[0]
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return nil, fmt.Errorf("%s is invalid, environment variables must be in the form of KEY[=VALUE]", e)
+	}
+	if len(arr) == 2 {
+		return setEnv(env, key, arr[1]), nil
+	}
+	if value, ok := os.LookupEnv(key); ok {
+		return setEnv(env, key, value), nil
+	}
+	return env, nil
+}
+
+// parseEnvFile reads KEY[=VALUE] lines, skipping blank lines and comments.
+// ${VAR} in values is expanded with the variables set so far, falling back to
+// the host.
+func parseEnvFile(path string, env []string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// setEnv modifies in place, keep the caller's env untouched.
+	env = append([]string{}, env...)
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		arr := strings.SplitN(line, "=", 2)
+		if len(arr) == 2 {
+			value := expandBraces(arr[1], func(key string) string {
+				if v, ok := lookupEnv(env, key); ok {
+					return v
+				}
+				return os.Getenv(key)
+			})
+			line = arr[0] + "=" + value
+			env = setEnv(env, arr[0], value)
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
+
+// expandBraces replaces ${VAR} in s with the value returned by mapping, and
+// $$ with $. Any other $ is kept, so values like passwords survive.
+func expandBraces(s string, mapping func(string) string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end <= 0 {
+				b.WriteByte(s[i])
+				continue
+			}
+			b.WriteString(mapping(s[i+2 : i+2+end]))
+			i += 2 + end
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func lookupEnv(env []string, key string) (string, bool) {
+	for _, e := range env {
+		if arr := strings.SplitN(e, "=", 2); arr[0] == key {
+			if len(arr) == 2 {
+				return arr[1], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+func unsetEnv(env []string, key string) []string {
+	var out []string
+	for _, e := range env {
+		if strings.SplitN(e, "=", 2)[0] != key {
+			out = append(out, e)
+		}
+	}
+	return out
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestExpandBraces(t *testing.T) {
+	vars := map[string]string{"A": "a", "EMPTY": ""}
+	mapping := func(key string) string { return vars[key] }
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "plain", want: "plain"},
+		{in: "${A}", want: "a"},
+		{in: "x${A}y${A}", want: "xaya"},
+		{in: "${EMPTY}-${UNSET}", want: "-"},
+		{in: "$A", want: "$A"},
+		{in: "pa$word", want: "pa$word"},
+		{in: "cost$", want: "cost$"},
+		{in: "$$", want: "$"},
+		{in: "$${A}", want: "${A}"},
+		{in: "${A", want: "${A"},
+		{in: "${}", want: "${}"},
+		{in: "$1$2", want: "$1$2"},
+	} {
+		if got := expandBraces(tc.in, mapping); got != tc.want {
+			t.Errorf("expandBraces(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	os.Setenv("BODMAN_TEST_HOST", "host")
+	defer os.Unsetenv("BODMAN_TEST_HOST")
+	for _, tc := range []struct {
+		name    string
+		content string
+		env     []string
+		want    []string
+	}{
+		{
+			name:    "comments and blank lines",
+			content: "# comment\n\nA=1\n  B=2  \n",
+			want:    []string{"A=1", "B=2"},
+		},
+		{
+			name:    "key only",
+			content: "A\n",
+			want:    []string{"A"},
+		},
+		{
+			name:    "expand earlier and image",
+			content: "A=1\nB=${A}-${IMAGE}\n",
+			env:     []string{"IMAGE=img"},
+			want:    []string{"A=1", "B=1-img"},
+		},
+		{
+			name:    "expand host",
+			content: "A=${BODMAN_TEST_HOST}\n",
+			want:    []string{"A=host"},
+		},
+		{
+			name:    "literal dollar",
+			content: "PASSWORD=pa$word\nPRICE=$$5\n",
+			want:    []string{"PASSWORD=pa$word", "PRICE=$5"},
+		},
+		{
+			name:    "value with equals",
+			content: "A=b=c\n",
+			want:    []string{"A=b=c"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bodman-env")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "env")
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseEnvFile(path, tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	os.Setenv("BODMAN_TEST_HOST", "host")
+	defer os.Unsetenv("BODMAN_TEST_HOST")
+	dir, err := ioutil.TempDir("", "bodman-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, "env")
+	if err := ioutil.WriteFile(envFile, []byte("A=file\nB=file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		imageEnv []string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "default path",
+			want: []string{"PATH=" + defaultPath},
+		},
+		{
+			name:     "image path",
+			imageEnv: []string{"PATH=/bin", "A=image"},
+			want:     []string{"PATH=/bin", "A=image"},
+		},
+		{
+			name:     "precedence",
+			args:     []string{"--env-file", envFile, "--env", "B=flag"},
+			imageEnv: []string{"PATH=/bin", "A=image"},
+			want:     []string{"PATH=/bin", "A=file", "B=flag"},
+		},
+		{
+			name:     "unsetenv",
+			args:     []string{"--unsetenv", "A", "--unsetenv", "PATH"},
+			imageEnv: []string{"PATH=/bin", "A=image", "C=image"},
+			want:     []string{"C=image"},
+		},
+		{
+			name: "host value",
+			args: []string{"--env", "BODMAN_TEST_HOST", "--env", "BODMAN_TEST_UNSET"},
+			want: []string{"PATH=" + defaultPath, "BODMAN_TEST_HOST=host"},
+		},
+		{
+			name:    "invalid key",
+			args:    []string{"--env", "A B=1"},
+			wantErr: true,
+		},
+		{
+			name:    "missing env file",
+			args:    []string{"--env-file", filepath.Join(dir, "missing")},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			for _, name := range []string{"env", "env-file", "unsetenv"} {
+				if err := (&cli.StringSliceFlag{Name: name}).Apply(set); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := set.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			got, err := buildEnv(cli.NewContext(cli.NewApp(), set, nil), tc.imageEnv)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
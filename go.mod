@@ -10,10 +10,12 @@ require (
 	github.com/containers/image/v5 v5.9.0
 	github.com/containers/libtrust v0.0.0-20200511145503-9c3a6c22cd9a // indirect
 	github.com/containers/storage v1.24.4
+	github.com/cyphar/filepath-securejoin v0.2.2
 	github.com/docker/docker v20.10.1+incompatible // indirect
 	github.com/fancl20/ostree-go v1.0.1
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
 	github.com/google/go-cmp v0.5.4 // indirect
+	github.com/google/nftables v0.0.0-20200802175506-c25e4f69b425
 	github.com/google/uuid v1.1.3
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
@@ -33,6 +35,7 @@ require (
 	github.com/ulikunitz/xz v0.5.9 // indirect
 	github.com/urfave/cli/v2 v2.3.0
 	github.com/vbauerster/mpb/v5 v5.4.0 // indirect
+	github.com/vishvananda/netlink v1.1.1-0.20201029203352-d40f9887b852
 	github.com/vishvananda/netns v0.0.0-20201230012202-c4f3ca719c73
 	github.com/xeipuuv/gojsonpointer v0.0.0-20190905194746-02993c407bfb // indirect
 	go.opencensus.io v0.22.5 // indirect
@@ -3,6 +3,7 @@ package main
 import (
 	"runtime"
 
+	"github.com/containers/storage/pkg/reexec"
 	"github.com/urfave/cli/v2"
 )
 
@@ -14,6 +15,10 @@ func init() {
 }
 
 func main() {
+	// chrootarchive re-executes bodman to unpack archives in a chroot.
+	if reexec.Init() {
+		return
+	}
 	app := cli.NewApp()
 	app.Name = "bodman"
 	app.HideHelp = true
@@ -39,8 +44,16 @@ func main() {
 		},
 	}
 	app.Commands = []*cli.Command{
+		newCommitCommand(),
+		newCopyCommand(),
+		newDiffCommand(),
+		newExportCommand(),
 		newGCCommand(),
 		newImageCommand(),
+		newInspectCommand(),
+		newNetworkCommand(),
+		newPodCommand(),
+		newPortCommand(),
 		newPullCommand(),
 		newRunCommand(),
 	}
@@ -0,0 +1,186 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/fancl20/bodman/mount"
+	"github.com/fancl20/bodman/network"
+)
+
+const containerStateFile = "container.json"
+
+// Container is the persistent state of a container, stored in the container
+// directory next to its rootfs.
+type Container struct {
+	ID   string
+	Name string `json:",omitempty"`
+	// Image is the normalized name of the image the container was checked
+	// out from, and Commit is the ostree commit the image pointed to.
+	Image  string
+	Commit string
+	// Pod is the ID of the pod the container joined.
+	Pod string `json:",omitempty"`
+
+	Hostname string
+	Config   *ContainerConfig `json:",omitempty"`
+	// Volumes are bind mounts from the host into the container rootfs.
+	Volumes []*mount.Mount
+	// Devices are paths of device nodes created from the host.
+	Devices []string
+	Sysctls map[string]string
+	// Ports are the published ports with the host ports actually used.
+	Ports []network.PortMapping `json:",omitempty"`
+
+	dir string
+}
+
+// ContainerConfig is the effective config of the container process, merged
+// from the image config and command line.
+type ContainerConfig struct {
+	Cmd        []string
+	Env        []string
+	User       string
+	WorkingDir string
+}
+
+func (c *Container) Dir() string {
+	return c.dir
+}
+
+func (c *Container) Rootfs() string {
+	return filepath.Join(c.dir, "rootfs")
+}
+
+// ResolvePath resolves a path inside the container to a path on the host. It
+// returns the directory which acts as the root of the resolved path, either
+// the container rootfs or the source of a volume. Symlinks are evaluated in
+// scope of the root, the last component is only evaluated if followLink is
+// set.
+func (c *Container) ResolvePath(p string, followLink bool) (string, string, error) {
+	p = filepath.Join("/", p)
+	root, rel := c.Rootfs(), p
+	var dest string
+	for _, v := range c.Volumes {
+		d := filepath.Join("/", v.Destination)
+		if len(d) <= len(dest) || !filepath.IsAbs(v.Source) {
+			continue
+		}
+		if r, err := filepath.Rel(d, p); err == nil && r != ".." && !strings.HasPrefix(r, "../") {
+			root, rel, dest = v.Source, filepath.Join("/", r), d
+		}
+	}
+	if rel == "/" {
+		return root, root, nil
+	}
+	if followLink {
+		resolved, err := securejoin.SecureJoin(root, rel)
+		return root, resolved, err
+	}
+	dir, err := securejoin.SecureJoin(root, filepath.Dir(rel))
+	if err != nil {
+		return "", "", err
+	}
+	return root, filepath.Join(dir, filepath.Base(rel)), nil
+}
+
+func (c *Container) Save() error {
+	f, err := os.Create(filepath.Join(c.dir, containerStateFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(c)
+}
+
+func loadContainer(dir string) (*Container, error) {
+	f, err := os.Open(filepath.Join(dir, containerStateFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c Container
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		return nil, err
+	}
+	c.dir = dir
+	return &c, nil
+}
+
+// listContainers loads the state of all containers. Containers without state
+// are skipped.
+func (m *Manager) listContainers() ([]*Container, error) {
+	containerDir := getContainersPath(m.base)
+	dirs, err := ioutil.ReadDir(containerDir)
+	if err != nil {
+		return nil, fmt.Errorf("List container directory failed: %w", err)
+	}
+	var containers []*Container
+	for _, d := range dirs {
+		c, err := loadContainer(filepath.Join(containerDir, d.Name()))
+		if err != nil {
+			continue
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// ContainerGet finds a container by its name, ID or an unique prefix of its
+// ID.
+func (m *Manager) ContainerGet(name string) (*Container, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Empty container name")
+	}
+	containers, err := m.listContainers()
+	if err != nil {
+		return nil, err
+	}
+	var found []*Container
+	for _, c := range containers {
+		if c.ID == name || c.Name == name {
+			return c, nil
+		}
+		if strings.HasPrefix(c.ID, name) {
+			found = append(found, c)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("No such container: %s", name)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("Ambiguous container name: %s", name)
+	}
+}
+
+// ContainerList loads the state of all containers.
+func (m *Manager) ContainerList() ([]*Container, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.listContainers()
+}
+
+// Running reports whether the container process is still alive, which holds
+// the lock of the container directory until it exits.
+func (c *Container) Running() (bool, error) {
+	l, err := tryLockFile(c.dir, false)
+	if err != nil {
+		return false, err
+	}
+	if l == nil {
+		return true, nil
+	}
+	l.Close()
+	return false, nil
+}
@@ -0,0 +1,43 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fancl20/bodman/repotree"
+)
+
+// ContainerChanges lists paths inside the container rootfs which differ from
+// the image commit the container was checked out from.
+type ContainerChanges struct {
+	Added   []string
+	Changed []string
+	Deleted []string
+}
+
+// ContainerDiff compares the container rootfs with its source commit. Files of
+// a user mode checkout are owned by the user who checked them out and carry
+// the user.ostreemeta xattr of bare-user objects, so they are compared as
+// owned by root and without xattrs, the way commit records them.
+func (m *Manager) ContainerDiff(c *Container) (*ContainerChanges, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	diff, err := repotree.Diff(getImagesPath(m.base), c.Commit, "/rootfs", c.Rootfs(), repotree.DiffOptions{
+		OwnerUid:     0,
+		OwnerGid:     0,
+		IgnoreXattrs: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Diff with commit %s failed: %w", c.Commit, err)
+	}
+	changes := &ContainerChanges{
+		Added:   diff.Added,
+		Changed: diff.Modified,
+		Deleted: diff.Removed,
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Changed)
+	sort.Strings(changes.Deleted)
+	return changes, nil
+}
@@ -0,0 +1,150 @@
+package manager
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fancl20/bodman/repotree"
+	"golang.org/x/sys/unix"
+)
+
+// ostreeMetaXattr holds the real metadata of objects in bare-user
+// repositories, and is never exported.
+const ostreeMetaXattr = "user.ostreemeta"
+
+// ContainerExport writes the container rootfs to w as a tar archive. Volumes
+// are not included. Ownership, permissions and xattrs of files unchanged from
+// the image are restored from the commit.
+func (m *Manager) ContainerExport(c *Container, w io.Writer) error {
+	if m.err != nil {
+		return m.err
+	}
+	repoPath := getImagesPath(m.base)
+	tree, err := repotree.ReadTree(repoPath, c.Commit, "/rootfs")
+	if err != nil {
+		return fmt.Errorf("Read commit %s failed: %w", c.Commit, err)
+	}
+	rootfs := c.Rootfs()
+	tw := tar.NewWriter(w)
+	if err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." || info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		orig := tree[filepath.Join("/", rel)]
+		var object string
+		if orig != nil {
+			object = repotree.ObjectPath(repoPath, orig.Checksum)
+		}
+		hdr, err := exportHeader(path, info, orig, object)
+		if err != nil {
+			return fmt.Errorf("Build tar header failed: %s: %w", path, err)
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// exportHeader builds the tar header of a file of the rootfs. orig is the file
+// at the same path in the commit, if any, and object the path of its object.
+func exportHeader(path string, info os.FileInfo, orig *repotree.FileInfo, object string) (*tar.Header, error) {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Uname, hdr.Gname = "", ""
+
+	// Files still hardlinked to their object are unchanged, but owned by
+	// the repository owner on disk. Anything else was created or written by
+	// the checkout or the container, and is exported as it is on disk.
+	var xattrs map[string][]byte
+	if orig != nil && info.Mode().IsRegular() && sameFile(info, object) {
+		hdr.Uid, hdr.Gid = int(orig.Uid), int(orig.Gid)
+		hdr.Mode = int64(orig.Mode & 07777)
+		xattrs = orig.Xattrs
+	} else if xattrs, err = readXattrs(path); err != nil {
+		return nil, err
+	}
+	for k, v := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+			hdr.Format = tar.FormatPAX
+		}
+		hdr.PAXRecords["SCHILY.xattr."+k] = string(v)
+	}
+	return hdr, nil
+}
+
+func sameFile(info os.FileInfo, path string) bool {
+	other, err := os.Lstat(path)
+	return err == nil && os.SameFile(info, other)
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+	sz, err := unix.Llistxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sz == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, sz)
+	if sz, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:sz]), "\x00"), "\x00") {
+		if name == "" || name == ostreeMetaXattr {
+			continue
+		}
+		sz, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, sz)
+		if sz, err = unix.Lgetxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:sz]
+	}
+	return xattrs, nil
+}
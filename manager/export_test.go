@@ -0,0 +1,115 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fancl20/bodman/repotree"
+	"golang.org/x/sys/unix"
+)
+
+func TestExportHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bodman-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	object := filepath.Join(dir, "object")
+	if err := ioutil.WriteFile(object, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The commit records the file as owned by 1000 with an xattr, which a
+	// bare-user repository doesn't apply to the object on disk.
+	orig := &repotree.FileInfo{
+		Mode:   unix.S_IFREG | 0640,
+		Uid:    1000,
+		Gid:    1000,
+		Xattrs: map[string][]byte{"user.origin": []byte("image")},
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+
+	for _, tc := range []struct {
+		name  string
+		setup func(path string) error
+		orig  *repotree.FileInfo
+		// want are the uid, gid and mode of the header.
+		wantUid, wantGid int
+		wantMode         int64
+		wantXattr        bool
+	}{
+		{
+			name:     "hardlinked",
+			setup:    func(path string) error { return os.Link(object, path) },
+			orig:     orig,
+			wantUid:  1000,
+			wantGid:  1000,
+			wantMode: 0640,
+			// Restored from the commit.
+			wantXattr: true,
+		},
+		{
+			// Rewritten by the container, which runs as the user owning
+			// the checkout.
+			name: "rewritten",
+			setup: func(path string) error {
+				if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+					return err
+				}
+				return os.Chmod(path, 0600)
+			},
+			orig:     orig,
+			wantUid:  uid,
+			wantGid:  gid,
+			wantMode: 0600,
+		},
+		{
+			name: "added",
+			setup: func(path string) error {
+				if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+					return err
+				}
+				return os.Chmod(path, 0644)
+			},
+			wantUid:  uid,
+			wantGid:  gid,
+			wantMode: 0644,
+		},
+		{
+			name: "directory",
+			setup: func(path string) error {
+				if err := os.Mkdir(path, 0750); err != nil {
+					return err
+				}
+				return os.Chmod(path, 0750)
+			},
+			orig:     &repotree.FileInfo{Mode: unix.S_IFDIR | 0755, Uid: 1000, Gid: 1000},
+			wantUid:  uid,
+			wantGid:  gid,
+			wantMode: 0750,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name)
+			if err := tc.setup(path); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdr, err := exportHeader(path, info, tc.orig, object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Uid != tc.wantUid || hdr.Gid != tc.wantGid || hdr.Mode&07777 != tc.wantMode {
+				t.Errorf("got %d:%d %o, want %d:%d %o", hdr.Uid, hdr.Gid, hdr.Mode&07777, tc.wantUid, tc.wantGid, tc.wantMode)
+			}
+			_, ok := hdr.PAXRecords["SCHILY.xattr.user.origin"]
+			if ok != tc.wantXattr {
+				t.Errorf("got xattr %v, want %v", ok, tc.wantXattr)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package manager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fancl20/bodman/mount"
+	"github.com/fancl20/bodman/network"
+	"golang.org/x/sys/unix"
+)
+
+// LeakPrune removes the resources of containers and pods which are gone
+// without cleaning up, like directories removed by hand. It returns the
+// descriptions of the removed resources, or of the ones to be removed if
+// dryRun is set. Leaked CNI networks are deleted with the config in
+// cniConfigDir and the plugins in cniPluginDir.
+func (m *Manager) LeakPrune(dryRun bool, cniConfigDir string, cniPluginDir []string) ([]string, []error, error) {
+	if m.err != nil {
+		return nil, nil, m.err
+	}
+	baseLock, err := tryLockFile(m.base, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Acquire base lock failed: %w", err)
+	}
+	defer baseLock.Close()
+
+	known, err := m.knownIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Mounts go first, since mounted namespaces keep network resources
+	// alive.
+	leaks, err := m.findMountLeaks(known)
+	if err != nil {
+		return nil, nil, err
+	}
+	netLeaks, err := network.FindLeaks(m.base, known, cniConfigDir, cniPluginDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaks = append(leaks, netLeaks...)
+
+	var removed []string
+	var errs []error
+	for _, l := range leaks {
+		if !dryRun {
+			if err := l.Remove(); err != nil {
+				errs = append(errs, fmt.Errorf("Remove %s failed: %w", l.Description, err))
+				continue
+			}
+		}
+		removed = append(removed, l.Description)
+	}
+	return removed, errs, nil
+}
+
+// knownIDs returns the IDs of all containers and pods with a directory.
+func (m *Manager) knownIDs() (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, dir := range []string{getContainersPath(m.base), getPodsPath(m.base)} {
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("List %s failed: %w", dir, err)
+		}
+		for _, e := range entries {
+			known[e.Name()] = true
+		}
+	}
+	return known, nil
+}
+
+// findMountLeaks finds mounts under the directories of unknown containers
+// and the namespaces of unknown pods. Containers mount in their own mount
+// namespace, so these are left by failures before unsharing.
+func (m *Manager) findMountLeaks(known map[string]bool) ([]*network.Leak, error) {
+	var dirs []string
+	for _, dir := range []string{getContainersPath(m.base), getPodNamespacesPath("")} {
+		// Mount points are reported with symlinks like /var/run resolved.
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		dirs = append(dirs, dir)
+	}
+	mounts, err := mount.GetMounts(nil)
+	if err != nil {
+		return nil, fmt.Errorf("List mounts failed: %w", err)
+	}
+	// Unmount the deepest first.
+	sort.Slice(mounts, func(i, j int) bool {
+		return len(mounts[i].Mountpoint) > len(mounts[j].Mountpoint)
+	})
+	var leaks []*network.Leak
+	for _, mi := range mounts {
+		for _, dir := range dirs {
+			rel, err := filepath.Rel(dir, mi.Mountpoint)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			if known[strings.Split(rel, string(filepath.Separator))[0]] {
+				continue
+			}
+			mountpoint := mi.Mountpoint
+			leaks = append(leaks, &network.Leak{
+				Description: "mount " + mountpoint,
+				Remove:      func() error { return unix.Unmount(mountpoint, unix.MNT_DETACH) },
+			})
+		}
+	}
+
+	// Pod namespace directories are left after unmounting.
+	entries, err := ioutil.ReadDir(getPodNamespacesPath(""))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("List pod namespaces failed: %w", err)
+	}
+	for _, e := range entries {
+		if known[e.Name()] {
+			continue
+		}
+		path := getPodNamespacesPath(e.Name())
+		leaks = append(leaks, &network.Leak{
+			Description: "pod namespaces " + path,
+			Remove:      func() error { return os.RemoveAll(path) },
+		})
+	}
+	return leaks, nil
+}
@@ -107,18 +107,58 @@ func GetManager(ctx *cli.Context) *Manager {
 	return cachedManager
 }
 
-func (m *Manager) ImageCommit(image, dir string) error {
+// ImageCommitOptions tweaks how a directory is committed as an image.
+type ImageCommitOptions struct {
+	// Parent is the checksum of the commit the new commit is derived from.
+	Parent string
+	// Overlays are directories committed on top of the source directory.
+	// Files in overlays replace the files with the same path.
+	Overlays []string
+	// Skip lists paths relative to the source directory which are excluded
+	// from the commit. Every path must exist.
+	Skip []string
+}
+
+func (m *Manager) ImageCommit(image, dir string, opts ImageCommitOptions) error {
 	if m.err != nil {
 		return m.err
 	}
-	if _, err := m.repo.PrepareTransaction(); err != nil {
-		return err
-	}
 	branch, err := encodeBranchFromImage(image)
 	if err != nil {
 		return err
 	}
-	if _, err := m.repo.Commit(dir, branch, ostree.NewCommitOptions()); err != nil {
+	commitOpts := ostree.NewCommitOptions()
+	commitOpts.Parent = opts.Parent
+	if len(opts.Overlays) > 0 {
+		commitOpts.Tree = []string{"dir=" + dir}
+		for _, o := range opts.Overlays {
+			commitOpts.Tree = append(commitOpts.Tree, "dir="+o)
+		}
+	}
+	if len(opts.Skip) > 0 {
+		skipList, err := ioutil.TempFile("", "bodman-skiplist-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(skipList.Name())
+		defer skipList.Close()
+		for _, s := range opts.Skip {
+			if _, err := fmt.Fprintln(skipList, filepath.Join("/", s)); err != nil {
+				return err
+			}
+		}
+		commitOpts.SkipListFile = skipList.Name()
+		// The skip list is only applied by the commit modifier, which
+		// otbuiltin creates when an owner is set. Its filter then sets
+		// the owner of every file, even when left at -1, so set the one
+		// user mode checkouts show to containers explicitly.
+		commitOpts.OwnerUID = 0
+		commitOpts.OwnerGID = 0
+	}
+	if _, err := m.repo.PrepareTransaction(); err != nil {
+		return err
+	}
+	if _, err := m.repo.Commit(dir, branch, commitOpts); err != nil {
 		return err
 	}
 	if _, err := m.repo.CommitTransaction(); err != nil {
@@ -127,31 +167,65 @@ func (m *Manager) ImageCommit(image, dir string) error {
 	return nil
 }
 
-func (m *Manager) ImageCheckout(image, container string) (string, *os.File, error) {
+func (m *Manager) ImageCheckout(image, container, name string) (*Container, *os.File, error) {
 	if m.err != nil {
-		return "", nil, m.err
+		return nil, nil, m.err
 	}
 	baseLock, err := tryLockFile(m.base, true)
 	if err != nil {
-		return "", nil, fmt.Errorf("Acquire base lock failed: %w", err)
+		return nil, nil, fmt.Errorf("Acquire base lock failed: %w", err)
 	}
 	defer baseLock.Close()
+	if name != "" {
+		containers, err := m.listContainers()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range containers {
+			if c.Name == name {
+				return nil, nil, fmt.Errorf("Container name %s is already used by %s", name, c.ID)
+			}
+		}
+	}
 	opts := ostree.NewCheckoutOptions()
 	opts.UserMode = true
 	opts.RequireHardlinks = true
 	dst := filepath.Join(getContainersPath(m.base), container)
 	branch, err := encodeBranchFromImage(image)
 	if err != nil {
-		return "", nil, m.err
+		return nil, nil, err
+	}
+	refs, err := m.repo.ListRefs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("List image refs failed: %w", err)
 	}
-	if err := ostree.Checkout(getImagesPath(m.base), dst, branch, opts); err != nil {
-		return "", nil, fmt.Errorf("Checkout image failed: %w", err)
+	commit, ok := refs[branch]
+	if !ok {
+		return nil, nil, fmt.Errorf("No such image: %s", image)
+	}
+	if err := ostree.Checkout(getImagesPath(m.base), dst, commit, opts); err != nil {
+		os.RemoveAll(dst)
+		return nil, nil, fmt.Errorf("Checkout image failed: %w", err)
 	}
 	containerLock, err := tryLockFile(dst, true)
 	if err != nil {
-		return "", nil, fmt.Errorf("Acquire container lock failed: %w", err)
-	}
-	return dst, containerLock, nil
+		os.RemoveAll(dst)
+		return nil, nil, fmt.Errorf("Acquire container lock failed: %w", err)
+	}
+	normalized, _ := normalizeImageName(image)
+	c := &Container{
+		ID:     container,
+		Name:   name,
+		Image:  normalized,
+		Commit: commit,
+		dir:    dst,
+	}
+	if err := c.Save(); err != nil {
+		os.RemoveAll(dst)
+		containerLock.Close()
+		return nil, nil, fmt.Errorf("Save container state failed: %w", err)
+	}
+	return c, containerLock, nil
 }
 
 func (m *Manager) ImageDelete(image string) error {
@@ -192,16 +266,19 @@ func (m *Manager) ImageList() ([]string, error) {
 
 }
 
-func (m *Manager) ImagePrune() (string, error) {
+func (m *Manager) ImagePrune(dryRun bool) (string, error) {
 	if m.err != nil {
 		return "", m.err
 	}
 	pruneOpt := ostree.NewPruneOptions()
 	pruneOpt.RefsOnly = true
+	pruneOpt.NoPrune = dryRun
 	return m.repo.Prune(pruneOpt)
 }
 
-func (m *Manager) ContainerPrune() ([]string, []error, error) {
+// ContainerPrune removes the stopped containers. It returns the directories
+// of removed containers, or of the ones to be removed if dryRun is set.
+func (m *Manager) ContainerPrune(dryRun bool) ([]string, []error, error) {
 	if m.err != nil {
 		return nil, nil, m.err
 	}
@@ -230,30 +307,42 @@ func (m *Manager) ContainerPrune() ([]string, []error, error) {
 			continue
 		}
 		l.Close()
+		if dryRun {
+			stopped = append(stopped, path)
+			continue
+		}
 
-		failed := false
-		if err := removeNetework(path); err != nil {
-			failed = true
+		// Keep the container directory if the network can't be fully
+		// removed, since it holds the cached CNI config needed by the
+		// next try.
+		if netErrs := removeNetework(path); len(netErrs) > 0 {
+			errs = append(errs, netErrs...)
+			continue
+		}
+		if err := network.UnregisterHosts(m.base, c.Name()); err != nil {
 			errs = append(errs, err)
 		}
 		if err := os.RemoveAll(path); err != nil {
-			failed = true
 			errs = append(errs, fmt.Errorf("Remove container dir failed: %s: %w", path, err))
+			continue
 		}
-		if !failed {
-			stopped = append(stopped, path)
-		}
+		stopped = append(stopped, path)
 	}
 	return stopped, errs, nil
 }
 
-func removeNetework(path string) error {
+func removeNetework(path string) []error {
 	n, err := network.Load(filepath.Join(path, "network.json"))
+	if os.IsNotExist(err) {
+		// The container exited before setting up network.
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("Load container network config failed: %s: %w", path, err)
+		return []error{fmt.Errorf("Load container network config failed: %s: %w", path, err)}
 	}
-	if err := n.Remove(); err != nil {
-		return fmt.Errorf("Remove container network failed: %s: %w", path, err)
+	var errs []error
+	for _, err := range n.Remove() {
+		errs = append(errs, fmt.Errorf("Remove container network failed: %s: %w", path, err))
 	}
-	return nil
+	return errs
 }
@@ -0,0 +1,412 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/fancl20/bodman/network"
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+)
+
+const podStateFile = "pod.json"
+
+func getPodsPath(base string) string {
+	return filepath.Join(base, "pods")
+}
+
+func getPodNamespacesPath(id string) string {
+	return filepath.Join("/var/run/bodman/pods", id)
+}
+
+// Pod is a group of containers sharing network, IPC and UTS namespaces. The
+// namespaces are bind mounted so they persist without any process in them.
+type Pod struct {
+	ID       string
+	Name     string
+	Hostname string
+	// Aliases are registered in the hosts files along with the names of
+	// every member.
+	Aliases  []string
+	Networks network.Networks
+	// IPCNamespace and UTSNamespace are the paths of the bind mounted
+	// namespaces.
+	IPCNamespace string
+	UTSNamespace string
+	// Used is set once a container joined the pod. Pods are removed by gc
+	// when they are used and have no running member left.
+	Used bool
+
+	dir string
+}
+
+func (p *Pod) Dir() string {
+	return p.dir
+}
+
+func (p *Pod) Save() error {
+	f, err := os.Create(filepath.Join(p.dir, podStateFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(p)
+}
+
+func loadPod(dir string) (*Pod, error) {
+	f, err := os.Open(filepath.Join(dir, podStateFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p Pod
+	if err := json.NewDecoder(f).Decode(&p); err != nil {
+		return nil, err
+	}
+	p.dir = dir
+	return &p, nil
+}
+
+func (m *Manager) listPods() ([]*Pod, error) {
+	podDir := getPodsPath(m.base)
+	dirs, err := ioutil.ReadDir(podDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("List pod directory failed: %w", err)
+	}
+	var pods []*Pod
+	for _, d := range dirs {
+		p, err := loadPod(filepath.Join(podDir, d.Name()))
+		if err != nil {
+			continue
+		}
+		pods = append(pods, p)
+	}
+	return pods, nil
+}
+
+func (m *Manager) PodList() ([]*Pod, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.listPods()
+}
+
+// PodGet finds a pod by its name or ID.
+func (m *Manager) PodGet(name string) (*Pod, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	pods, err := m.listPods()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pods {
+		if p.ID == name || p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("No such pod: %s", name)
+}
+
+// PodCreate creates a pod and its namespaces. aliases are the extra names of
+// the pod on its networks. newNetworks creates the network config of the
+// pod, given the pod ID and the CNI cache directory.
+func (m *Manager) PodCreate(name, hostname string, aliases []string, newNetworks func(id, cacheDir string) (network.Networks, error)) (*Pod, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Empty pod name")
+	}
+	baseLock, err := tryLockFile(m.base, true)
+	if err != nil {
+		return nil, fmt.Errorf("Acquire base lock failed: %w", err)
+	}
+	defer baseLock.Close()
+	pods, err := m.listPods()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pods {
+		if p.Name == name {
+			return nil, fmt.Errorf("Pod name %s is already used by %s", name, p.ID)
+		}
+	}
+
+	id := uuid.New().String()
+	p := &Pod{
+		ID:           id,
+		Name:         name,
+		Hostname:     hostname,
+		Aliases:      aliases,
+		IPCNamespace: filepath.Join(getPodNamespacesPath(id), "ipc"),
+		UTSNamespace: filepath.Join(getPodNamespacesPath(id), "uts"),
+		dir:          filepath.Join(getPodsPath(m.base), id),
+	}
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return nil, err
+	}
+	if p.Networks, err = newNetworks(id, filepath.Join(p.dir, "cni")); err != nil {
+		os.RemoveAll(p.dir)
+		return nil, fmt.Errorf("Create network config failed: %w", err)
+	}
+	if _, err := p.Networks.NamespacePath(); err != nil {
+		os.RemoveAll(p.dir)
+		return nil, err
+	}
+	// Saved before creating anything, so gc can clean up a broken pod.
+	if err := p.Save(); err != nil {
+		os.RemoveAll(p.dir)
+		return nil, fmt.Errorf("Save pod state failed: %w", err)
+	}
+	if err := p.createNamespaces(); err != nil {
+		for _, e := range p.remove() {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return nil, err
+	}
+	// The result of the networks is only available after executed.
+	if err := p.Save(); err != nil {
+		return nil, fmt.Errorf("Save pod state failed: %w", err)
+	}
+	return p, nil
+}
+
+// createNamespaces creates the namespaces in a new thread, which is thrown
+// away after so the namespaces don't leak to the rest of the process.
+func (p *Pod) createNamespaces() error {
+	errCh := make(chan error)
+	go func() {
+		// Not unlocked, so the thread exits with the goroutine.
+		runtime.LockOSThread()
+		errCh <- func() error {
+			if err := p.Networks.Execute(); err != nil {
+				return fmt.Errorf("Execute network config failed: %w", err)
+			}
+			if err := unix.Unshare(unix.CLONE_NEWIPC | unix.CLONE_NEWUTS); err != nil {
+				return fmt.Errorf("Unshare namespaces failed: %w", err)
+			}
+			if err := unix.Sethostname([]byte(p.Hostname)); err != nil {
+				return fmt.Errorf("Sethostname failed: %w", err)
+			}
+			tid := unix.Gettid()
+			if err := bindNamespace(fmt.Sprintf("/proc/self/task/%d/ns/ipc", tid), p.IPCNamespace); err != nil {
+				return err
+			}
+			return bindNamespace(fmt.Sprintf("/proc/self/task/%d/ns/uts", tid), p.UTSNamespace)
+		}()
+	}()
+	return <-errCh
+}
+
+func bindNamespace(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := unix.Mount(src, dst, "none", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("Bind mount %s failed: %w", src, err)
+	}
+	return nil
+}
+
+// remove removes the namespaces and state of the pod. All steps are tried
+// even if some of them failed.
+func (p *Pod) remove() []error {
+	var errs []error
+	for _, err := range p.Networks.Remove() {
+		errs = append(errs, fmt.Errorf("Remove pod network failed: %s: %w", p.Name, err))
+	}
+	for _, path := range []string{p.IPCNamespace, p.UTSNamespace} {
+		if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+			errs = append(errs, fmt.Errorf("Unmount %s failed: %w", path, err))
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("Remove %s failed: %w", path, err))
+		}
+	}
+	if len(errs) > 0 {
+		// Keep the state, so the next try knows what to clean up.
+		return errs
+	}
+	if err := os.Remove(getPodNamespacesPath(p.ID)); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+	if err := os.RemoveAll(p.dir); err != nil {
+		errs = append(errs, fmt.Errorf("Remove pod dir failed: %s: %w", p.dir, err))
+	}
+	return errs
+}
+
+// PodMembers returns the running containers in the pod.
+func (m *Manager) PodMembers(p *Pod) ([]*Container, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	containers, err := m.listContainers()
+	if err != nil {
+		return nil, err
+	}
+	var members []*Container
+	for _, c := range containers {
+		if c.Pod != p.ID {
+			continue
+		}
+		if running, err := c.Running(); err != nil || !running {
+			continue
+		}
+		members = append(members, c)
+	}
+	return members, nil
+}
+
+// PodJoin records c as a member of the pod before it joins the namespaces,
+// so gc keeps the pod from then on. The caller must hold the lock of c. It
+// reports whether c is the first container to join the pod, which PodLeave
+// needs if c fails to start.
+func (m *Manager) PodJoin(p *Pod, c *Container) (bool, error) {
+	if m.err != nil {
+		return false, m.err
+	}
+	baseLock, err := tryLockFile(m.base, true)
+	if err != nil {
+		return false, fmt.Errorf("Acquire base lock failed: %w", err)
+	}
+	defer baseLock.Close()
+	// Reloaded since the pod may have been removed after it was looked up.
+	cur, err := loadPod(p.dir)
+	if err != nil {
+		return false, fmt.Errorf("Load pod %s failed: %w", p.Name, err)
+	}
+	c.Pod = cur.ID
+	if err := c.Save(); err != nil {
+		return false, fmt.Errorf("Save container state failed: %w", err)
+	}
+	first := !cur.Used
+	if first {
+		cur.Used = true
+		if err := cur.Save(); err != nil {
+			return false, fmt.Errorf("Save pod state failed: %w", err)
+		}
+	}
+	*p = *cur
+	return first, nil
+}
+
+// PodLeave reverts PodJoin for a container which failed to start. If it was
+// the first to join, the pod is marked unused again unless another container
+// joined meanwhile, so gc doesn't remove a pod which never ran anything.
+func (m *Manager) PodLeave(p *Pod, c *Container, first bool) error {
+	if m.err != nil {
+		return m.err
+	}
+	baseLock, err := tryLockFile(m.base, true)
+	if err != nil {
+		return fmt.Errorf("Acquire base lock failed: %w", err)
+	}
+	defer baseLock.Close()
+	c.Pod = ""
+	if err := c.Save(); err != nil {
+		return fmt.Errorf("Save container state failed: %w", err)
+	}
+	if !first {
+		return nil
+	}
+	containers, err := m.listContainers()
+	if err != nil {
+		return err
+	}
+	for _, other := range containers {
+		if other.ID != c.ID && other.Pod == p.ID {
+			return nil
+		}
+	}
+	cur, err := loadPod(p.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Load pod %s failed: %w", p.Name, err)
+	}
+	cur.Used = false
+	if err := cur.Save(); err != nil {
+		return fmt.Errorf("Save pod state failed: %w", err)
+	}
+	*p = *cur
+	return nil
+}
+
+// PodRemove removes a pod without running members.
+func (m *Manager) PodRemove(p *Pod) []error {
+	if m.err != nil {
+		return []error{m.err}
+	}
+	baseLock, err := tryLockFile(m.base, true)
+	if err != nil {
+		return []error{fmt.Errorf("Acquire base lock failed: %w", err)}
+	}
+	defer baseLock.Close()
+	members, err := m.PodMembers(p)
+	if err != nil {
+		return []error{err}
+	}
+	if len(members) > 0 {
+		return []error{fmt.Errorf("Pod %s has %d running containers", p.Name, len(members))}
+	}
+	return p.remove()
+}
+
+// PodPrune removes the pods whose last member is gone. It returns the names
+// of removed pods, or of the ones to be removed if dryRun is set.
+func (m *Manager) PodPrune(dryRun bool) ([]string, []error, error) {
+	if m.err != nil {
+		return nil, nil, m.err
+	}
+	baseLock, err := tryLockFile(m.base, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Acquire base lock failed: %w", err)
+	}
+	defer baseLock.Close()
+	pods, err := m.listPods()
+	if err != nil {
+		return nil, nil, err
+	}
+	var removed []string
+	var errs []error
+	for _, p := range pods {
+		if !p.Used {
+			continue
+		}
+		members, err := m.PodMembers(p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(members) > 0 {
+			continue
+		}
+		if dryRun {
+			removed = append(removed, p.Name)
+			continue
+		}
+		if perrs := p.remove(); len(perrs) > 0 {
+			errs = append(errs, perrs...)
+			continue
+		}
+		removed = append(removed, p.Name)
+	}
+	return removed, errs, nil
+}
@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPodLeave(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// used is whether a container joined the pod before.
+		used bool
+		// other is whether another container joins while the first one
+		// starts.
+		other    bool
+		wantUsed bool
+	}{
+		{name: "first member failed", wantUsed: false},
+		{name: "later member failed", used: true, wantUsed: true},
+		{name: "joined meanwhile", other: true, wantUsed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			base, err := ioutil.TempDir("", "bodman-pod")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(base)
+			m := &Manager{base: base}
+			newContainer := func(id string) *Container {
+				c := &Container{ID: id, dir: filepath.Join(getContainersPath(base), id)}
+				if err := os.MkdirAll(c.dir, 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := c.Save(); err != nil {
+					t.Fatal(err)
+				}
+				return c
+			}
+			p := &Pod{ID: "pod", Name: "web", Used: tc.used, dir: filepath.Join(getPodsPath(base), "pod")}
+			if err := os.MkdirAll(p.dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			c := newContainer("c1")
+			first, err := m.PodJoin(p, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first == tc.used || !p.Used {
+				t.Fatalf("PodJoin: first %v, used %v", first, p.Used)
+			}
+			if tc.other {
+				if _, err := m.PodJoin(p, newContainer("c2")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := m.PodLeave(p, c, first); err != nil {
+				t.Fatal(err)
+			}
+
+			saved, err := loadPod(p.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.Used != tc.wantUsed {
+				t.Errorf("got used %v, want %v", saved.Used, tc.wantUsed)
+			}
+			if c, err = loadContainer(c.dir); err != nil || c.Pod != "" {
+				t.Errorf("container still in pod %q: %v", c.Pod, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/urfave/cli/v2"
+)
+
+// parseStaticAddresses parses the addresses requested by --ip, --ip6 and
+// --mac-address.
+func parseStaticAddresses(ctx *cli.Context) ([]net.IP, net.HardwareAddr, error) {
+	var ips []net.IP
+	if s := ctx.String("ip"); s != "" {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() == nil {
+			return nil, nil, fmt.Errorf("Invalid IPv4 address %s", s)
+		}
+		ips = append(ips, ip.To4())
+	}
+	if s := ctx.String("ip6"); s != "" {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return nil, nil, fmt.Errorf("Invalid IPv6 address %s", s)
+		}
+		ips = append(ips, ip)
+	}
+	var mac net.HardwareAddr
+	if s := ctx.String("mac-address"); s != "" {
+		var err error
+		if mac, err = net.ParseMAC(s); err != nil {
+			return nil, nil, fmt.Errorf("Invalid MAC address %s: %w", s, err)
+		}
+	}
+	return ips, mac, nil
+}
+
+// validateStaticAddresses checks the network can assign the requested
+// addresses. Plugins silently ignore capability args they don't declare, so
+// the capabilities must be checked up front.
+func (n *Network) validateStaticAddresses(ips []net.IP, mac net.HardwareAddr) error {
+	if len(ips) == 0 && mac == nil {
+		return nil
+	}
+	var subnets []*net.IPNet
+	if !n.managed() {
+		return fmt.Errorf("Static addresses need a cni network, not %s", n.NetworkName)
+	}
+	switch n.NetworkName {
+	case bridgeNetworkName:
+		_, subnet, err := net.ParseCIDR(readBridgeSubnet(n.BridgeStateFile))
+		if err != nil {
+			return err
+		}
+		subnets = append(subnets, subnet)
+	default:
+		netconf, err := libcni.LoadConfList(n.CNIConfigDir, n.NetworkName)
+		if err != nil {
+			return fmt.Errorf("Load cni config failed: %w", err)
+		}
+		if len(ips) > 0 && !hasCapability(netconf, "ips") {
+			return fmt.Errorf("Network %s doesn't support static IP addresses", n.NetworkName)
+		}
+		if mac != nil && !hasCapability(netconf, "mac") {
+			return fmt.Errorf("Network %s doesn't support static MAC addresses", n.NetworkName)
+		}
+		for _, p := range netconf.Plugins {
+			subnets = append(subnets, pluginSubnets(p)...)
+		}
+	}
+	if len(subnets) == 0 {
+		// Unknown IPAM, let the plugin validate addresses.
+		return nil
+	}
+next:
+	for _, ip := range ips {
+		for _, subnet := range subnets {
+			if subnet.Contains(ip) {
+				continue next
+			}
+		}
+		return fmt.Errorf("Address %s is not in any subnet of network %s", ip, n.NetworkName)
+	}
+	return nil
+}
+
+// staticIPs returns the addresses requested through the ips capability.
+func (n *Network) staticIPs() []net.IP {
+	var ips []net.IP
+	switch v := n.RuntimeConfig.CapabilityArgs["ips"].(type) {
+	case []string:
+		for _, s := range v {
+			ips = append(ips, net.ParseIP(s))
+		}
+	case []interface{}:
+		// Loaded from a dumped config.
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				ips = append(ips, net.ParseIP(s))
+			}
+		}
+	}
+	return ips
+}
+
+// staticMAC returns the address requested through the mac capability.
+func (n *Network) staticMAC() net.HardwareAddr {
+	s, _ := n.RuntimeConfig.CapabilityArgs["mac"].(string)
+	mac, _ := net.ParseMAC(s)
+	return mac
+}
+
+// pluginSubnets returns the subnets of the IPAM config of a plugin, in the
+// format of host-local.
+func pluginSubnets(p *libcni.NetworkConfig) []*net.IPNet {
+	var plugin struct {
+		IPAM struct {
+			Subnet string        `json:"subnet"`
+			Ranges [][]ipamRange `json:"ranges"`
+		} `json:"ipam"`
+	}
+	if err := json.Unmarshal(p.Bytes, &plugin); err != nil {
+		return nil
+	}
+	subnets := []string{plugin.IPAM.Subnet}
+	for _, rs := range plugin.IPAM.Ranges {
+		for _, r := range rs {
+			subnets = append(subnets, r.Subnet)
+		}
+	}
+	var nets []*net.IPNet
+	for _, s := range subnets {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
@@ -0,0 +1,558 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// The native bridge driver connects containers to a bridge on the host
+// without any CNI plugin installed. Addresses are allocated from a subnet
+// stored in the base directory, traffic leaving the subnet is masqueraded.
+// The network is named after bodman rather than its driver, so it doesn't
+// shadow the CNI configs commonly named bridge.
+const (
+	bridgeNetworkName  = "bodman"
+	bridgeName         = "bodman0"
+	bridgeDefaultNet   = "10.88.0.0/16"
+	bridgeNftTableName = "bodman"
+	ipForwardPath      = "/proc/sys/net/ipv4/ip_forward"
+)
+
+func getBridgeStateFile(base string) string {
+	return filepath.Join(base, "networks", "bridge.json")
+}
+
+// bridgeIPAM is the address allocation state of the bridge network.
+type bridgeIPAM struct {
+	Subnet string
+	// Allocations maps allocated addresses to container IDs.
+	Allocations map[string]string
+	// IPForward is the value of net.ipv4.ip_forward before the bridge was
+	// set up, restored once the last address is released.
+	IPForward string `json:",omitempty"`
+}
+
+// withBridgeIPAM runs fn with the allocation state locked, and saves the
+// state if fn succeeds.
+func withBridgeIPAM(path string, fn func(*bridgeIPAM) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	ipam := &bridgeIPAM{Subnet: bridgeDefaultNet}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, ipam); err != nil {
+			return fmt.Errorf("Parse %s failed: %w", path, err)
+		}
+	}
+	if ipam.Allocations == nil {
+		ipam.Allocations = make(map[string]string)
+	}
+	if err := fn(ipam); err != nil {
+		return err
+	}
+	if content, err = json.Marshal(ipam); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(content, 0)
+	return err
+}
+
+// allocate returns the address allocated to the container, allocating the
+// requested one or the lowest free one if there is none. The first address
+// of the subnet is the gateway.
+func (ipam *bridgeIPAM) allocate(containerID string, requested net.IP) (*net.IPNet, net.IP, error) {
+	_, subnet, err := net.ParseCIDR(ipam.Subnet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid bridge subnet %s: %w", ipam.Subnet, err)
+	}
+	if subnet.IP.To4() == nil {
+		return nil, nil, fmt.Errorf("Bridge subnet %s is not IPv4", ipam.Subnet)
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, nil, fmt.Errorf("Bridge subnet %s is too small", ipam.Subnet)
+	}
+	start := binary.BigEndian.Uint32(subnet.IP.To4())
+	size := uint32(1) << uint(bits-ones)
+	gateway := make(net.IP, 4)
+	binary.BigEndian.PutUint32(gateway, start+1)
+	for ip, id := range ipam.Allocations {
+		if id == containerID {
+			return &net.IPNet{IP: net.ParseIP(ip).To4(), Mask: subnet.Mask}, gateway, nil
+		}
+	}
+	if requested != nil {
+		requested = requested.To4()
+		offset := binary.BigEndian.Uint32(requested) - start
+		if !subnet.Contains(requested) || offset < 2 || offset >= size-1 {
+			return nil, nil, fmt.Errorf("Address %s is not usable in bridge subnet %s", requested, ipam.Subnet)
+		}
+		if id, ok := ipam.Allocations[requested.String()]; ok {
+			return nil, nil, fmt.Errorf("Address %s is already used by %s", requested, id)
+		}
+		ipam.Allocations[requested.String()] = containerID
+		return &net.IPNet{IP: requested, Mask: subnet.Mask}, gateway, nil
+	}
+	// Skip network, gateway and broadcast address.
+	for i := uint32(2); i < size-1; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, start+i)
+		if _, ok := ipam.Allocations[ip.String()]; ok {
+			continue
+		}
+		ipam.Allocations[ip.String()] = containerID
+		return &net.IPNet{IP: ip, Mask: subnet.Mask}, gateway, nil
+	}
+	return nil, nil, fmt.Errorf("No free address in bridge subnet %s", ipam.Subnet)
+}
+
+func (ipam *bridgeIPAM) release(containerID string) {
+	for ip, id := range ipam.Allocations {
+		if id == containerID {
+			delete(ipam.Allocations, ip)
+		}
+	}
+}
+
+// bridgeVethNames returns the names of the host side and the temporary name
+// of the container side of the veth pair, unique per container and within
+// IFNAMSIZ.
+func bridgeVethNames(containerID string) (string, string) {
+	id := strings.Replace(containerID, "-", "", -1)
+	if len(id) > 11 {
+		id = id[:11]
+	}
+	return "veth" + id, "vtmp" + id
+}
+
+// setupBridge connects the netns to the bridge and returns the result in
+// the format of CNI.
+func (n *Network) setupBridge(ns netns.NsHandle) (*current.Result, error) {
+	containerID := n.RuntimeConfig.ContainerID
+	var ipnet *net.IPNet
+	var gateway net.IP
+	var subnet *net.IPNet
+	var requested net.IP
+	for _, ip := range n.staticIPs() {
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("IPv6 is not supported by the bridge network")
+		}
+		requested = ip
+	}
+	// The bridge and its rules are set up with the allocation state locked,
+	// so releasing the last address doesn't tear them down meanwhile.
+	var br netlink.Link
+	if err := withBridgeIPAM(n.BridgeStateFile, func(ipam *bridgeIPAM) error {
+		var err error
+		if ipnet, gateway, err = ipam.allocate(containerID, requested); err != nil {
+			return fmt.Errorf("Allocate address failed: %w", err)
+		}
+		if _, subnet, err = net.ParseCIDR(ipam.Subnet); err != nil {
+			return err
+		}
+		if br, err = ensureBridge(&net.IPNet{IP: gateway, Mask: subnet.Mask}); err != nil {
+			return fmt.Errorf("Setup bridge %s failed: %w", bridgeName, err)
+		}
+		if err := ensureMasquerade(subnet); err != nil {
+			return fmt.Errorf("Setup masquerade failed: %w", err)
+		}
+		if err := ensureForward(); err != nil {
+			return fmt.Errorf("Setup forwarding failed: %w", err)
+		}
+		if err := ipam.enableIPForward(); err != nil {
+			return fmt.Errorf("Enable ip forwarding failed: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	hostName, peerName := bridgeVethNames(containerID)
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        hostName,
+			MasterIndex: br.Attrs().Index,
+		},
+		PeerName:         peerName,
+		PeerHardwareAddr: n.staticMAC(),
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, fmt.Errorf("Create veth %s failed: %w", hostName, err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		return nil, fmt.Errorf("Set veth %s up failed: %w", hostName, err)
+	}
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetNsFd(peer, int(ns)); err != nil {
+		return nil, fmt.Errorf("Move veth %s to netns failed: %w", peerName, err)
+	}
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Delete()
+	link, err := h.LinkByName(peerName)
+	if err != nil {
+		return nil, err
+	}
+	ifName := n.RuntimeConfig.IfName
+	if err := h.LinkSetName(link, ifName); err != nil {
+		return nil, fmt.Errorf("Rename veth %s failed: %w", peerName, err)
+	}
+	if err := h.AddrAdd(link, &netlink.Addr{IPNet: ipnet}); err != nil {
+		return nil, fmt.Errorf("Add address %s failed: %w", ipnet, err)
+	}
+	if err := h.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("Set %s up failed: %w", ifName, err)
+	}
+	if err := h.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: gateway}); err != nil {
+		return nil, fmt.Errorf("Add default route failed: %w", err)
+	}
+	if link, err = h.LinkByName(ifName); err != nil {
+		return nil, err
+	}
+
+	sandboxIndex := 2
+	return &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{
+			{Name: bridgeName, Mac: br.Attrs().HardwareAddr.String()},
+			{Name: hostName},
+			{Name: ifName, Mac: link.Attrs().HardwareAddr.String(), Sandbox: n.RuntimeConfig.NetNS},
+		},
+		IPs: []*current.IPConfig{
+			{Version: "4", Interface: &sandboxIndex, Address: *ipnet, Gateway: gateway},
+		},
+	}, nil
+}
+
+// enableIPForward enables net.ipv4.ip_forward, recording the previous value
+// when the bridge is set up first.
+func (ipam *bridgeIPAM) enableIPForward() error {
+	if ipam.IPForward == "" {
+		content, err := ioutil.ReadFile(ipForwardPath)
+		if err != nil {
+			return err
+		}
+		ipam.IPForward = strings.TrimSpace(string(content))
+	}
+	return ioutil.WriteFile(ipForwardPath, []byte("1"), 0644)
+}
+
+// teardown removes the bridge, the table of bodman and the rules inserted into
+// the FORWARD chain of iptables-nft, and restores net.ipv4.ip_forward. It runs
+// once no address is allocated.
+func (ipam *bridgeIPAM) teardown() []error {
+	var errs []error
+	if br, err := netlink.LinkByName(bridgeName); err == nil {
+		if err := netlink.LinkDel(br); err != nil {
+			errs = append(errs, fmt.Errorf("Delete bridge %s failed: %w", bridgeName, err))
+		}
+	} else if !errors.As(err, &netlink.LinkNotFoundError{}) {
+		errs = append(errs, fmt.Errorf("Get bridge %s failed: %w", bridgeName, err))
+	}
+	if err := removeNftRules(); err != nil {
+		errs = append(errs, fmt.Errorf("Remove nftables rules failed: %w", err))
+	}
+	if ipam.IPForward != "" {
+		if err := ioutil.WriteFile(ipForwardPath, []byte(ipam.IPForward), 0644); err != nil {
+			errs = append(errs, fmt.Errorf("Restore ip forwarding failed: %w", err))
+		} else {
+			ipam.IPForward = ""
+		}
+	}
+	return errs
+}
+
+func ensureBridge(gateway *net.IPNet) (netlink.Link, error) {
+	br, err := netlink.LinkByName(bridgeName)
+	if errors.As(err, &netlink.LinkNotFoundError{}) {
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}}); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		br, err = netlink.LinkByName(bridgeName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.IPNet.String() == gateway.String() {
+			found = true
+		}
+	}
+	if !found {
+		if err := netlink.AddrAdd(br, &netlink.Addr{IPNet: gateway}); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// ensureMasquerade (re)creates the nat rule masquerading traffic from the
+// subnet leaving through other interfaces than the bridge.
+func ensureMasquerade(subnet *net.IPNet) error {
+	c := &nftables.Conn{}
+	table := c.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyIPv4,
+		Name:   bridgeNftTableName,
+	})
+	chain := c.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	c.FlushChain(chain)
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, bridgeName)
+	c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			// ip saddr & mask == subnet
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: subnet.Mask, Xor: make([]byte, 4)},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: subnet.IP.To4()},
+			// oifname != bridge
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ifname},
+			&expr.Masq{},
+		},
+	})
+	return c.Flush()
+}
+
+// ensureForward accepts forwarded traffic from the bridge and replies to it,
+// in the table of bodman and in the FORWARD chain of iptables-nft if there is
+// one, since a drop verdict of any base chain is final. The FORWARD chain of
+// legacy iptables can't be reached through nftables.
+func ensureForward() error {
+	c := &nftables.Conn{}
+	table := c.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyIPv4,
+		Name:   bridgeNftTableName,
+	})
+	policy := nftables.ChainPolicyAccept
+	chain := c.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	c.FlushChain(chain)
+	for _, exprs := range bridgeForwardRules() {
+		c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	ch, err := iptablesForwardChain(c)
+	if err != nil || ch == nil {
+		return err
+	}
+	rules, err := c.GetRule(ch.Table, ch)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if matchesBridge(r.Exprs) {
+			return nil
+		}
+	}
+	for _, exprs := range bridgeForwardRules() {
+		c.InsertRule(&nftables.Rule{Table: ch.Table, Chain: ch, Exprs: exprs})
+	}
+	return c.Flush()
+}
+
+// removeNftRules deletes the table of bodman and the rules ensureForward
+// inserted into the FORWARD chain of iptables-nft.
+func removeNftRules() error {
+	c := &nftables.Conn{}
+	tables, err := c.ListTables()
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if t.Family == nftables.TableFamilyIPv4 && t.Name == bridgeNftTableName {
+			c.DelTable(t)
+		}
+	}
+	ch, err := iptablesForwardChain(c)
+	if err != nil {
+		return err
+	}
+	if ch != nil {
+		rules, err := c.GetRule(ch.Table, ch)
+		if err != nil {
+			return err
+		}
+		for _, r := range rules {
+			if matchesBridge(r.Exprs) {
+				// Rules are listed without the family of their table.
+				r.Table, r.Chain = ch.Table, ch
+				if err := c.DelRule(r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return c.Flush()
+}
+
+// iptablesForwardChain returns the FORWARD chain of iptables-nft, or nil if
+// there is none.
+func iptablesForwardChain(c *nftables.Conn) (*nftables.Chain, error) {
+	chains, err := c.ListChains()
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chains {
+		if ch.Table.Family == nftables.TableFamilyIPv4 && ch.Table.Name == "filter" && ch.Name == "FORWARD" {
+			return ch, nil
+		}
+	}
+	return nil, nil
+}
+
+// bridgeForwardRules returns "iifname bodman0 accept" and "oifname bodman0
+// ct state established,related accept".
+func bridgeForwardRules() [][]expr.Any {
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, bridgeName)
+	return [][]expr.Any{
+		{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+		{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname},
+			&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(ctStateEstablished | ctStateRelated),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	}
+}
+
+// Bits of ct state, NF_CT_STATE_BIT of IP_CT_ESTABLISHED and IP_CT_RELATED.
+const (
+	ctStateEstablished = 1 << 1
+	ctStateRelated     = 1 << 2
+)
+
+// matchesBridge reports whether a rule compares an interface name with the
+// bridge, which is how rules inserted by ensureForward are recognized.
+func matchesBridge(exprs []expr.Any) bool {
+	for i, e := range exprs {
+		meta, ok := e.(*expr.Meta)
+		if !ok || (meta.Key != expr.MetaKeyIIFNAME && meta.Key != expr.MetaKeyOIFNAME) || i+1 >= len(exprs) {
+			continue
+		}
+		if cmp, ok := exprs[i+1].(*expr.Cmp); ok && strings.TrimRight(string(cmp.Data), "\x00") == bridgeName {
+			return true
+		}
+	}
+	return false
+}
+
+// removeBridge removes the veth pair of the container and releases its
+// address. The bridge and its rules are shared, and torn down with the last
+// address.
+func (n *Network) removeBridge() []error {
+	var errs []error
+	hostName, _ := bridgeVethNames(n.RuntimeConfig.ContainerID)
+	if link, err := netlink.LinkByName(hostName); err == nil {
+		if err := netlink.LinkDel(link); err != nil {
+			errs = append(errs, fmt.Errorf("Delete veth %s failed: %w", hostName, err))
+		}
+	} else if !errors.As(err, &netlink.LinkNotFoundError{}) {
+		errs = append(errs, fmt.Errorf("Get veth %s failed: %w", hostName, err))
+	}
+	if err := withBridgeIPAM(n.BridgeStateFile, func(ipam *bridgeIPAM) error {
+		ipam.release(n.RuntimeConfig.ContainerID)
+		if len(ipam.Allocations) == 0 {
+			errs = append(errs, ipam.teardown()...)
+		}
+		return nil
+	}); err != nil {
+		errs = append(errs, fmt.Errorf("Release address failed: %w", err))
+	}
+	return errs
+}
+
+// checkBridge checks the veth pair of the container is still attached to
+// the bridge.
+func (n *Network) checkBridge() []error {
+	hostName, _ := bridgeVethNames(n.RuntimeConfig.ContainerID)
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return []error{fmt.Errorf("Get bridge %s failed: %w", bridgeName, err)}
+	}
+	link, err := netlink.LinkByName(hostName)
+	if err != nil {
+		return []error{fmt.Errorf("Get veth %s failed: %w", hostName, err)}
+	}
+	var errs []error
+	if link.Attrs().MasterIndex != br.Attrs().Index {
+		errs = append(errs, fmt.Errorf("Veth %s is not attached to %s", hostName, bridgeName))
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		errs = append(errs, fmt.Errorf("Veth %s is down", hostName))
+	}
+	return errs
+}
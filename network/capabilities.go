@@ -0,0 +1,141 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/urfave/cli/v2"
+)
+
+// Capability args set by bodman itself, which can't be given by
+// --network-opt.
+var reservedCapabilities = map[string]string{
+	"portMappings": "--publish",
+	"ips":          "--ip and --ip6",
+	"mac":          "--mac-address",
+}
+
+// parseCapabilityArgs parses the flags passed to plugins as capability args.
+// The network must declare every one of them.
+func parseCapabilityArgs(ctx *cli.Context) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	bandwidth := make(map[string]uint64)
+	for _, dir := range []string{"ingress", "egress"} {
+		rate, err := parseBits(ctx.String(dir + "-rate"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s rate: %w", dir, err)
+		}
+		burst, err := parseBits(ctx.String(dir + "-burst"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s burst: %w", dir, err)
+		}
+		if burst != 0 && rate == 0 {
+			return nil, fmt.Errorf("--%s-burst needs --%s-rate", dir, dir)
+		}
+		if rate == 0 {
+			continue
+		}
+		if burst == 0 {
+			// Allow a second of traffic at the full rate.
+			burst = rate
+		}
+		bandwidth[dir+"Rate"] = rate
+		bandwidth[dir+"Burst"] = burst
+	}
+	if len(bandwidth) > 0 {
+		args["bandwidth"] = bandwidth
+	}
+	if ranges := ctx.StringSlice("ip-range"); len(ranges) > 0 {
+		var ipRanges [][]ipamRange
+		for _, r := range ranges {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				return nil, fmt.Errorf("Invalid IP range %s: %w", r, err)
+			}
+			ipRanges = append(ipRanges, []ipamRange{{Subnet: r}})
+		}
+		args["ipRanges"] = ipRanges
+	}
+	if guid := ctx.String("infiniband-guid"); guid != "" {
+		args["infinibandGUID"] = guid
+	}
+	for _, opt := range ctx.StringSlice("network-opt") {
+		arr := strings.SplitN(opt, "=", 2)
+		if len(arr) != 2 || arr[0] == "" {
+			return nil, fmt.Errorf("%s is invalid, network options must be in the form of KEY=JSON", opt)
+		}
+		if flag, ok := reservedCapabilities[arr[0]]; ok {
+			return nil, fmt.Errorf("Capability %s is set by %s", arr[0], flag)
+		}
+		if _, ok := args[arr[0]]; ok {
+			return nil, fmt.Errorf("Capability %s is set by its own flag", arr[0])
+		}
+		var value json.RawMessage
+		if err := json.Unmarshal([]byte(arr[1]), &value); err != nil {
+			return nil, fmt.Errorf("Invalid value of network option %s: %w", arr[0], err)
+		}
+		args[arr[0]] = value
+	}
+	return args, nil
+}
+
+// parseBits parses a number of bits with an optional k, m or g suffix.
+func parseBits(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	orig, multiplier := s, uint64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		multiplier = 1000
+	case "m":
+		multiplier = 1000 * 1000
+	case "g":
+		multiplier = 1000 * 1000 * 1000
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("%s is out of range", orig)
+	}
+	return v * multiplier, nil
+}
+
+// applyCapabilityArgs sets args on the network, which must declare all of
+// them since plugins silently ignore capability args they don't declare.
+// dns and aliases are set only if declared, as they are served by bodman
+// otherwise.
+func (n *Network) applyCapabilityArgs(args map[string]interface{}, dns map[string][]string, aliases []string) error {
+	if !n.managed() || n.NetworkName == bridgeNetworkName {
+		for key := range args {
+			return fmt.Errorf("Network %s doesn't support the %s capability", n.NetworkName, key)
+		}
+		return nil
+	}
+	netconf, err := libcni.LoadConfList(n.CNIConfigDir, n.NetworkName)
+	if err != nil {
+		return fmt.Errorf("Load cni config failed: %w", err)
+	}
+	for key, value := range args {
+		if !hasCapability(netconf, key) {
+			return fmt.Errorf("Network %s doesn't support the %s capability", n.NetworkName, key)
+		}
+		n.RuntimeConfig.CapabilityArgs[key] = value
+	}
+	if len(dns) > 0 && hasCapability(netconf, "dns") {
+		n.RuntimeConfig.CapabilityArgs["dns"] = dns
+	}
+	if len(aliases) > 0 && hasCapability(netconf, "aliases") {
+		n.RuntimeConfig.CapabilityArgs["aliases"] = map[string][]string{n.NetworkName: aliases}
+	}
+	return nil
+}
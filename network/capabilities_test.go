@@ -0,0 +1,153 @@
+package network
+
+import (
+	"encoding/json"
+	"flag"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseBits(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "100", want: 100},
+		{in: "10k", want: 10000},
+		{in: "10K", want: 10000},
+		{in: "5m", want: 5000000},
+		{in: "2g", want: 2000000000},
+		{in: "18446744073709551615", want: 18446744073709551615},
+		{in: "18446744073g", want: 18446744073000000000},
+		{in: "18446744074g", wantErr: true},
+		{in: "18446744073709552k", wantErr: true},
+		{in: "k", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1.5m", wantErr: true},
+		{in: "10t", wantErr: true},
+	} {
+		got, err := parseBits(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseBits(%q) = %d, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseBits(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func newCapabilityContext(t *testing.T, args []string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range []cli.Flag{
+		&cli.StringFlag{Name: "egress-burst"},
+		&cli.StringFlag{Name: "egress-rate"},
+		&cli.StringFlag{Name: "infiniband-guid"},
+		&cli.StringFlag{Name: "ingress-burst"},
+		&cli.StringFlag{Name: "ingress-rate"},
+		&cli.StringSliceFlag{Name: "ip-range"},
+		&cli.StringSliceFlag{Name: "network-opt"},
+	} {
+		if err := f.Apply(set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func TestParseCapabilityArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "none",
+			want: `{}`,
+		},
+		{
+			name: "bandwidth",
+			args: []string{"--ingress-rate", "1m", "--egress-rate", "2m", "--egress-burst", "500k"},
+			want: `{"bandwidth":{"egressBurst":500000,"egressRate":2000000,"ingressBurst":1000000,"ingressRate":1000000}}`,
+		},
+		{
+			name:    "burst without rate",
+			args:    []string{"--ingress-burst", "1m"},
+			wantErr: true,
+		},
+		{
+			name:    "rate overflow",
+			args:    []string{"--egress-rate", "99999999999g"},
+			wantErr: true,
+		},
+		{
+			name: "ip ranges",
+			args: []string{"--ip-range", "10.89.0.0/24", "--ip-range", "fd00::/64"},
+			want: `{"ipRanges":[[{"subnet":"10.89.0.0/24"}],[{"subnet":"fd00::/64"}]]}`,
+		},
+		{
+			name:    "invalid ip range",
+			args:    []string{"--ip-range", "10.89.0.0"},
+			wantErr: true,
+		},
+		{
+			name: "infiniband guid",
+			args: []string{"--infiniband-guid", "c2:11:22:33:44:55:66:77"},
+			want: `{"infinibandGUID":"c2:11:22:33:44:55:66:77"}`,
+		},
+		{
+			name: "network opt",
+			args: []string{"--network-opt", `custom={"a":1}`},
+			want: `{"custom":{"a":1}}`,
+		},
+		{
+			name:    "network opt without value",
+			args:    []string{"--network-opt", "custom"},
+			wantErr: true,
+		},
+		{
+			name:    "network opt invalid json",
+			args:    []string{"--network-opt", "custom=a"},
+			wantErr: true,
+		},
+		{
+			name:    "network opt reserved",
+			args:    []string{"--network-opt", `mac="c2:11:22:33:44:55"`},
+			wantErr: true,
+		},
+		{
+			name:    "network opt set by flag",
+			args:    []string{"--ingress-rate", "1m", "--network-opt", `bandwidth={}`},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args, err := parseCapabilityArgs(newCapabilityContext(t, tc.args))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want error", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
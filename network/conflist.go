@@ -0,0 +1,260 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/containernetworking/cni/libcni"
+)
+
+// ConfList is a CNI network config found in the config dir.
+type ConfList struct {
+	Path string
+	*libcni.NetworkConfigList
+}
+
+// IsBuiltin reports whether the network is handled by bodman itself instead
+// of a CNI config.
+func IsBuiltin(name string) bool {
+	return name == "host" || name == "none" || name == bridgeNetworkName
+}
+
+// ListConfLists loads all network configs in dir, in the order libcni looks
+// them up: conflists first, then single network configs, each sorted by
+// file name. Single network configs are converted to lists. Invalid files
+// are skipped with a warning, so a broken file doesn't hide the others.
+func ListConfLists(dir string) ([]*ConfList, error) {
+	lists, err := libcni.ConfFiles(dir, []string{".conflist"})
+	if err != nil {
+		return nil, err
+	}
+	singles, err := libcni.ConfFiles(dir, []string{".conf", ".json"})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(lists)
+	sort.Strings(singles)
+	var confs []*ConfList
+	for _, file := range append(lists, singles...) {
+		var conf *libcni.NetworkConfigList
+		if filepath.Ext(file) == ".conflist" {
+			conf, err = libcni.ConfListFromFile(file)
+		} else {
+			var single *libcni.NetworkConfig
+			if single, err = libcni.ConfFromFile(file); err == nil {
+				conf, err = libcni.ConfListFromConf(single)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skip invalid network config %s: %v\n", file, err)
+			continue
+		}
+		confs = append(confs, &ConfList{Path: file, NetworkConfigList: conf})
+	}
+	return confs, nil
+}
+
+// CreateOptions are the options of a network created by CreateConfList.
+type CreateOptions struct {
+	Subnet  string
+	Gateway string
+	// IPv6 adds an IPv6 subnet, a random unique local one if IPv6Subnet is
+	// empty.
+	IPv6       bool
+	IPv6Subnet string
+	// Internal networks have no default route and no masquerade.
+	Internal bool
+}
+
+type ipamRange struct {
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway,omitempty"`
+}
+
+type ipamRoute struct {
+	Dst string `json:"dst"`
+}
+
+// CreateConfList writes a conflist of a bridge network into dir and returns
+// its path.
+func CreateConfList(dir, name string, opts CreateOptions) (string, error) {
+	if IsBuiltin(name) {
+		return "", fmt.Errorf("Network %s is built-in", name)
+	}
+	confs, err := ListConfLists(dir)
+	if err != nil {
+		return "", err
+	}
+	usedBridges := make(map[string]bool)
+	var usedSubnets []*net.IPNet
+	for _, c := range confs {
+		if c.Name == name {
+			return "", fmt.Errorf("Network %s already exists in %s", name, c.Path)
+		}
+		for _, p := range c.Plugins {
+			var plugin struct {
+				Bridge string `json:"bridge"`
+			}
+			if err := json.Unmarshal(p.Bytes, &plugin); err == nil {
+				usedBridges[plugin.Bridge] = true
+			}
+			usedSubnets = append(usedSubnets, pluginSubnets(p)...)
+		}
+	}
+	if _, n, err := net.ParseCIDR(bridgeDefaultNet); err == nil {
+		usedSubnets = append(usedSubnets, n)
+	}
+
+	subnet := opts.Subnet
+	if subnet == "" {
+		if subnet, err = freeSubnet(usedSubnets); err != nil {
+			return "", err
+		}
+	} else if _, n, err := net.ParseCIDR(subnet); err != nil || n.IP.To4() == nil {
+		return "", fmt.Errorf("Invalid IPv4 subnet %s", subnet)
+	}
+	if opts.Gateway != "" {
+		_, n, _ := net.ParseCIDR(subnet)
+		if gw := net.ParseIP(opts.Gateway); gw == nil || !n.Contains(gw) {
+			return "", fmt.Errorf("Gateway %s is not in subnet %s", opts.Gateway, subnet)
+		}
+	}
+	ranges := [][]ipamRange{{{Subnet: subnet, Gateway: opts.Gateway}}}
+	routes := []ipamRoute{{Dst: "0.0.0.0/0"}}
+	if opts.IPv6 || opts.IPv6Subnet != "" {
+		subnet6 := opts.IPv6Subnet
+		if subnet6 == "" {
+			if subnet6, err = randomULASubnet(); err != nil {
+				return "", err
+			}
+		} else if _, n, err := net.ParseCIDR(subnet6); err != nil || n.IP.To4() != nil {
+			return "", fmt.Errorf("Invalid IPv6 subnet %s", subnet6)
+		}
+		ranges = append(ranges, []ipamRange{{Subnet: subnet6}})
+		routes = append(routes, ipamRoute{Dst: "::/0"})
+	}
+	if opts.Internal {
+		routes = nil
+	}
+
+	var bridge string
+	for i := 0; ; i++ {
+		bridge = fmt.Sprintf("cni-bodman%d", i)
+		if !usedBridges[bridge] {
+			break
+		}
+	}
+	conf := map[string]interface{}{
+		"cniVersion": "0.4.0",
+		"name":       name,
+		"plugins": []interface{}{
+			map[string]interface{}{
+				"type":         "bridge",
+				"bridge":       bridge,
+				"isGateway":    true,
+				"ipMasq":       !opts.Internal,
+				"hairpinMode":  true,
+				"capabilities": map[string]bool{"ips": true},
+				"ipam": map[string]interface{}{
+					"type":   "host-local",
+					"ranges": ranges,
+					"routes": routes,
+				},
+			},
+			map[string]interface{}{
+				"type":         "portmap",
+				"capabilities": map[string]bool{"portMappings": true},
+			},
+			map[string]interface{}{
+				"type": "firewall",
+			},
+			map[string]interface{}{
+				"type":         "tuning",
+				"capabilities": map[string]bool{"mac": true},
+			},
+			map[string]interface{}{
+				"type":         "bandwidth",
+				"capabilities": map[string]bool{"bandwidth": true},
+			},
+		},
+	}
+	content, err := json.MarshalIndent(conf, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name+".conflist")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(content, '\n')); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// freeSubnet returns the first 10.89.x.0/24 not overlapping used.
+func freeSubnet(used []*net.IPNet) (string, error) {
+next:
+	for i := 0; i < 256; i++ {
+		ip := net.IPv4(10, 89, byte(i), 0)
+		for _, n := range used {
+			if n.Contains(ip) || (&net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}).Contains(n.IP) {
+				continue next
+			}
+		}
+		return fmt.Sprintf("10.89.%d.0/24", i), nil
+	}
+	return "", fmt.Errorf("No free subnet in 10.89.0.0/16, specify one with --subnet")
+}
+
+func randomULASubnet() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ip := net.IP{0xfd, b[0], b[1], b[2], b[3], b[4], 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}).String(), nil
+}
+
+// RemoveConfList removes the file of the network config.
+func RemoveConfList(dir, name string) error {
+	if IsBuiltin(name) {
+		return fmt.Errorf("Network %s is built-in", name)
+	}
+	confs, err := ListConfLists(dir)
+	if err != nil {
+		return err
+	}
+	for _, c := range confs {
+		if c.Name == name {
+			return os.Remove(c.Path)
+		}
+	}
+	return fmt.Errorf("No such network: %s", name)
+}
+
+// BridgeSubnet returns the subnet of the native bridge network.
+func BridgeSubnet(base string) string {
+	return readBridgeSubnet(getBridgeStateFile(base))
+}
+
+func readBridgeSubnet(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return bridgeDefaultNet
+	}
+	ipam := &bridgeIPAM{Subnet: bridgeDefaultNet}
+	json.Unmarshal(content, ipam)
+	return ipam.Subnet
+}
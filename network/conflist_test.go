@@ -0,0 +1,71 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestListConfLists(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name: "conflists first",
+			files: map[string]string{
+				"10-a.conf":     `{"cniVersion": "0.4.0", "name": "a", "type": "bridge"}`,
+				"20-b.conflist": `{"cniVersion": "0.4.0", "name": "b", "plugins": [{"type": "bridge"}]}`,
+				"30-c.json":     `{"cniVersion": "0.4.0", "name": "c", "type": "bridge"}`,
+				"05-d.conflist": `{"cniVersion": "0.4.0", "name": "d", "plugins": [{"type": "bridge"}]}`,
+			},
+			want: []string{"d", "b", "a", "c"},
+		},
+		{
+			name: "invalid skipped",
+			files: map[string]string{
+				"10-a.conflist": `{"cniVersion": "0.4.0", "name": "a", "plugins": [{"type": "bridge"}]}`,
+				"20-b.conflist": `{"name": "b",`,
+				"30-c.conflist": `{"cniVersion": "0.4.0", "name": "c"}`,
+				"40-d.conf":     `not json`,
+				"50-e.conf":     `{"cniVersion": "0.4.0", "name": "e", "type": "bridge"}`,
+			},
+			want: []string{"a", "e"},
+		},
+		{
+			name: "other files ignored",
+			files: map[string]string{
+				"10-a.conflist": `{"cniVersion": "0.4.0", "name": "a", "plugins": [{"type": "bridge"}]}`,
+				"README":        `not a config`,
+			},
+			want: []string{"a"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bodman-cni")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for name, content := range tc.files {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			confs, err := ListConfLists(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range confs {
+				got = append(got, c.Name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containers/storage/pkg/reexec"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	portForwarderName         = "bodman-port-forwarder"
+	portForwarderLauncherName = "bodman-port-forwarder-launcher"
+)
+
+// portForwarderPidfd is the pidfd of the container process passed to the
+// helper, the first of ExtraFiles.
+const portForwarderPidfd = 3
+
+// udpIdleTimeout is how long a UDP flow is kept without any traffic.
+const udpIdleTimeout = 90 * time.Second
+
+// maxAcceptDelay caps the backoff after temporary errors, same as net/http.
+const maxAcceptDelay = time.Second
+
+func init() {
+	reexec.Register(portForwarderName, portForwarderMain)
+	reexec.Register(portForwarderLauncherName, portForwarderLauncherMain)
+}
+
+// PortForwarder is a helper process forwarding published ports from the host
+// to the container in userspace, used if the network has no plugin supporting
+// port mappings. It must be started in the host namespaces. It runs until
+// the process which started it, and becomes the container process, exited.
+type PortForwarder struct {
+	w *os.File
+}
+
+type portForwarderConfig struct {
+	Target       net.IP
+	PortMappings []PortMapping
+}
+
+// StartPortForwarder starts the helper process. It does nothing until
+// Forward is called.
+//
+// The helper is started through a launcher which exits right away, so it
+// isn't left as a zombie child of the container process, which doesn't know
+// about it. The launcher hands it a pidfd of the current process to watch,
+// opened while the current process is certainly alive.
+func StartPortForwarder() (*PortForwarder, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	cmd := &exec.Cmd{
+		Path:   reexec.Self(),
+		Args:   []string{portForwarderLauncherName, strconv.Itoa(os.Getpid())},
+		Stdin:  r,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Run(); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("Start port forwarder failed: %w", err)
+	}
+	return &PortForwarder{w: w}, nil
+}
+
+// Forward sends the port mappings to the helper.
+func (p *PortForwarder) Forward(target net.IP, mappings []PortMapping) error {
+	defer p.w.Close()
+	if err := json.NewEncoder(p.w).Encode(&portForwarderConfig{
+		Target:       target,
+		PortMappings: mappings,
+	}); err != nil {
+		return fmt.Errorf("Send port mappings failed: %w", err)
+	}
+	return nil
+}
+
+// Stop makes the helper exit if Forward wasn't called yet. Otherwise it exits
+// with the current process.
+func (p *PortForwarder) Stop() error {
+	p.w.Close()
+	return nil
+}
+
+func portForwarderLauncherMain() {
+	log.SetPrefix(portForwarderLauncherName + ": ")
+	pid, err := strconv.Atoi(os.Args[1])
+	if err != nil || pid != os.Getppid() {
+		log.Fatalf("Invalid parent pid: %s", os.Args[1])
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_PIDFD_OPEN, uintptr(pid), 0, 0)
+	if errno != 0 {
+		log.Fatalf("Open pidfd failed: %v", errno)
+	}
+	pidfd := os.NewFile(fd, "pidfd")
+	cmd := &exec.Cmd{
+		Path:       reexec.Self(),
+		Args:       []string{portForwarderName},
+		Stdin:      os.Stdin,
+		Stderr:     os.Stderr,
+		ExtraFiles: []*os.File{pidfd},
+		// Keep signals to the process group of the container, like Ctrl-C,
+		// away from the helper.
+		SysProcAttr: &unix.SysProcAttr{Setsid: true},
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Start failed: %v", err)
+	}
+	os.Exit(0)
+}
+
+func portForwarderMain() {
+	log.SetPrefix(portForwarderName + ": ")
+	var cfg portForwarderConfig
+	if err := json.NewDecoder(os.Stdin).Decode(&cfg); err != nil {
+		// The container failed to start.
+		os.Exit(0)
+	}
+	os.Stdin.Close()
+	for _, m := range cfg.PortMappings {
+		target := net.JoinHostPort(cfg.Target.String(), strconv.Itoa(int(m.ContainerPort)))
+		addr := net.JoinHostPort(m.HostIP, strconv.Itoa(int(m.HostPort)))
+		switch m.Protocol {
+		case protoTCP:
+			l, err := net.Listen(protoTCP, addr)
+			if err != nil {
+				log.Fatalf("Listen %s failed: %v", m, err)
+			}
+			go forwardTCP(l, target)
+		case protoUDP:
+			conn, err := net.ListenPacket(protoUDP, addr)
+			if err != nil {
+				log.Fatalf("Listen %s failed: %v", m, err)
+			}
+			go forwardUDP(conn, target)
+		}
+	}
+	// The pidfd becomes readable once the container process exited.
+	fds := []unix.PollFd{{Fd: portForwarderPidfd, Events: unix.POLLIN}}
+	for {
+		if _, err := unix.Poll(fds, -1); err != unix.EINTR {
+			break
+		}
+	}
+	os.Exit(0)
+}
+
+// backoff sleeps after a temporary error and returns the next delay, or
+// returns 0 if err is permanent.
+func backoff(err error, delay time.Duration) time.Duration {
+	if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+		return 0
+	}
+	if delay == 0 {
+		delay = 5 * time.Millisecond
+	} else if delay *= 2; delay > maxAcceptDelay {
+		delay = maxAcceptDelay
+	}
+	time.Sleep(delay)
+	return delay
+}
+
+func forwardTCP(l net.Listener, target string) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if delay = backoff(err, delay); delay == 0 {
+				log.Printf("Accept on %s failed, stop forwarding: %v", l.Addr(), err)
+				return
+			}
+			continue
+		}
+		delay = 0
+		go func() {
+			defer conn.Close()
+			backend, err := net.Dial(protoTCP, target)
+			if err != nil {
+				log.Printf("Dial %s failed: %v", target, err)
+				return
+			}
+			defer backend.Close()
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go copyHalf(&wg, backend.(*net.TCPConn), conn.(*net.TCPConn))
+			go copyHalf(&wg, conn.(*net.TCPConn), backend.(*net.TCPConn))
+			wg.Wait()
+		}()
+	}
+}
+
+func copyHalf(wg *sync.WaitGroup, dst, src *net.TCPConn) {
+	defer wg.Done()
+	io.Copy(dst, src)
+	dst.CloseWrite()
+	src.CloseRead()
+}
+
+// udpFlows holds a socket connected to the target for every client, so
+// replies can be sent back to the client.
+type udpFlows struct {
+	mu     sync.Mutex
+	conn   net.PacketConn
+	target string
+	flows  map[string]net.Conn
+}
+
+// get returns the socket of client, dialing a new one if the flow is gone.
+func (f *udpFlows) get(client net.Addr) (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if backend, ok := f.flows[client.String()]; ok {
+		return backend, nil
+	}
+	backend, err := net.Dial(protoUDP, f.target)
+	if err != nil {
+		return nil, err
+	}
+	f.flows[client.String()] = backend
+	go f.reply(client, backend)
+	return backend, nil
+}
+
+// drop closes backend and forgets it if it's still the socket of client.
+func (f *udpFlows) drop(client net.Addr, backend net.Conn) {
+	f.mu.Lock()
+	if f.flows[client.String()] == backend {
+		delete(f.flows, client.String())
+	}
+	f.mu.Unlock()
+	backend.Close()
+}
+
+func (f *udpFlows) reply(client net.Addr, backend net.Conn) {
+	defer f.drop(client, backend)
+	buf := make([]byte, 65535)
+	for {
+		backend.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := backend.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := f.conn.WriteTo(buf[:n], client); err != nil {
+			log.Printf("Reply to %s failed: %v", client, err)
+		}
+	}
+}
+
+func forwardUDP(conn net.PacketConn, target string) {
+	flows := &udpFlows{conn: conn, target: target, flows: make(map[string]net.Conn)}
+	buf := make([]byte, 65535)
+	var delay time.Duration
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if delay = backoff(err, delay); delay == 0 {
+				log.Printf("Read on %s failed, stop forwarding: %v", conn.LocalAddr(), err)
+				return
+			}
+			continue
+		}
+		delay = 0
+		// The flow may time out and be closed between get and Write, in
+		// which case it's dialed again.
+		for retry := 0; retry < 2; retry++ {
+			backend, err := flows.get(client)
+			if err != nil {
+				log.Printf("Dial %s failed: %v", target, err)
+				break
+			}
+			if _, err := backend.Write(buf[:n]); err == nil {
+				break
+			}
+			flows.drop(client, backend)
+		}
+	}
+}
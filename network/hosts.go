@@ -0,0 +1,289 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+)
+
+// The hosts registry records the names and addresses of containers by the
+// networks they are attached to. Every member gets the entries of the others
+// in its /etc/hosts, below the marker line.
+const hostsMarker = "# Containers on the same networks, managed by bodman"
+
+func getHostsRegistryFile(base string) string {
+	return filepath.Join(base, "networks", "hosts.json")
+}
+
+type hostsEntry struct {
+	Names []string
+	IP    string
+	// Rootfs is the rootfs of the container seen from the host, empty if the
+	// container keeps the hosts file of the image.
+	Rootfs string `json:",omitempty"`
+	// Dir is the container directory, which is locked while the container
+	// runs.
+	Dir string `json:",omitempty"`
+}
+
+// running reports whether the container of the entry still runs, the same way
+// the manager does. Entries recorded without the directory are kept.
+func (e *hostsEntry) running() bool {
+	if e.Dir == "" {
+		return true
+	}
+	fd, err := unix.Open(e.Dir, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+	return errors.Is(unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB), unix.EWOULDBLOCK)
+}
+
+type hostsRegistry struct {
+	// Networks maps network names to the entries of their members by
+	// container ID.
+	Networks map[string]map[string]*hostsEntry
+}
+
+// withHostsRegistry runs fn with the registry locked, and saves the registry
+// if fn succeeds.
+func withHostsRegistry(path string, fn func(*hostsRegistry) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	r := &hostsRegistry{}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, r); err != nil {
+			return fmt.Errorf("Parse %s failed: %w", path, err)
+		}
+	}
+	if r.Networks == nil {
+		r.Networks = make(map[string]map[string]*hostsEntry)
+	}
+	if err := fn(r); err != nil {
+		return err
+	}
+	if content, err = json.Marshal(r); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(content, 0)
+	return err
+}
+
+// lines returns the hosts file lines of the running containers sharing a
+// network with the container.
+func (r *hostsRegistry) lines(containerID string, running map[string]bool) []string {
+	seen := make(map[string]bool)
+	var lines []string
+	for _, members := range r.Networks {
+		if _, ok := members[containerID]; !ok {
+			continue
+		}
+		for id, e := range members {
+			line := e.IP + "\t" + strings.Join(e.Names, " ")
+			if id == containerID || !running[id] || seen[line] {
+				continue
+			}
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// refresh rewrites the hosts files of all running members. Containers which
+// exited are left out until they are unregistered, since nothing runs when
+// they exit. A member may be gone or broken, which must not fail the others,
+// so errors are ignored.
+func (r *hostsRegistry) refresh() {
+	running := make(map[string]bool)
+	rootfs := make(map[string]string)
+	for _, members := range r.Networks {
+		for id, e := range members {
+			if _, ok := running[id]; ok {
+				continue
+			}
+			running[id] = e.running()
+			if running[id] && e.Rootfs != "" {
+				rootfs[id] = e.Rootfs
+			}
+		}
+	}
+	for id, root := range rootfs {
+		updateHostsFile(root, r.lines(id, running))
+	}
+}
+
+// RegisterHosts adds the container to the registry of every network it has an
+// address on, and updates the hosts files of all members including itself.
+// rootfs is empty if the hosts file of the container isn't managed, and dir is
+// the container directory locked while it runs.
+func RegisterHosts(base, containerID string, names []string, rootfs, dir string, networks Networks) error {
+	err := withHostsRegistry(getHostsRegistryFile(base), func(r *hostsRegistry) error {
+		for _, n := range networks {
+			ip := n.ContainerIP()
+			if ip == nil {
+				continue
+			}
+			if r.Networks[n.NetworkName] == nil {
+				r.Networks[n.NetworkName] = make(map[string]*hostsEntry)
+			}
+			r.Networks[n.NetworkName][containerID] = &hostsEntry{
+				Names:  names,
+				IP:     ip.String(),
+				Rootfs: rootfs,
+				Dir:    dir,
+			}
+		}
+		r.refresh()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Register hosts failed: %w", err)
+	}
+	return nil
+}
+
+// UnregisterHosts removes the container from the registry, and updates the
+// hosts files of the remaining members.
+func UnregisterHosts(base, containerID string) error {
+	path := getHostsRegistryFile(base)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	err := withHostsRegistry(path, func(r *hostsRegistry) error {
+		changed := false
+		for name, members := range r.Networks {
+			if _, ok := members[containerID]; !ok {
+				continue
+			}
+			changed = true
+			delete(members, containerID)
+			if len(members) == 0 {
+				delete(r.Networks, name)
+			}
+		}
+		if changed {
+			r.refresh()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unregister hosts failed: %w", err)
+	}
+	return nil
+}
+
+// ResolveHostsFile returns the path of /etc/hosts in rootfs. The rootfs is
+// controlled by the container while the file is written from the host, so
+// symlinks are resolved in scope of rootfs, and anything but a regular file
+// is rejected.
+func ResolveHostsFile(rootfs string) (string, error) {
+	path, err := securejoin.SecureJoin(rootfs, "/etc/hosts")
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Lstat(path); err == nil && !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	return path, nil
+}
+
+// updateHostsFile replaces the entries below the marker line of the hosts
+// file in rootfs with lines. The path is resolved again on every update, and
+// the file is only accessed relative to its directory without following
+// symlinks, since the container may have changed it meanwhile. The file is
+// replaced instead of written in place, since it may be hard linked to the
+// image.
+func updateHostsFile(rootfs string, lines []string) error {
+	path, err := ResolveHostsFile(rootfs)
+	if err != nil {
+		return err
+	}
+	dir, err := unix.Open(filepath.Dir(path), unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Open %s failed: %w", filepath.Dir(path), err)
+	}
+	defer unix.Close(dir)
+	name := filepath.Base(path)
+	fd, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Open %s failed: %w", path, err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if i := bytes.Index(content, []byte(hostsMarker+"\n")); i >= 0 {
+		content = content[:i]
+	}
+	if len(lines) > 0 {
+		content = append(content, hostsMarker+"\n"+strings.Join(lines, "\n")+"\n"...)
+	}
+	return replaceFileAt(dir, name, content, 0644)
+}
+
+// replaceFileAt writes content to a temporary file and renames it to name in
+// dir, so files hard linked to name are left untouched.
+func replaceFileAt(dir int, name string, content []byte, perm uint32) error {
+	tmp := fmt.Sprintf(".%s.%s", name, strings.Replace(uuid.New().String(), "-", "", -1)[:8])
+	fd, err := unix.Openat(dir, tmp, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, perm)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), tmp)
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		unix.Unlinkat(dir, tmp, 0)
+		return err
+	}
+	// Not subject to umask, unlike the mode of openat.
+	if err := f.Chmod(os.FileMode(perm)); err != nil {
+		f.Close()
+		unix.Unlinkat(dir, tmp, 0)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		unix.Unlinkat(dir, tmp, 0)
+		return err
+	}
+	if err := unix.Renameat(dir, tmp, dir, name); err != nil {
+		unix.Unlinkat(dir, tmp, 0)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestUpdateHostsFile(t *testing.T) {
+	const base = "127.0.0.1\tlocalhost\n"
+	lines := []string{"10.88.0.3\tweb"}
+	updated := base + hostsMarker + "\n10.88.0.3\tweb\n"
+	for _, tc := range []struct {
+		name string
+		// setup populates rootfs, outside is a directory outside of it.
+		setup   func(rootfs, outside string) error
+		wantErr bool
+		// want is the content of path in rootfs after the update.
+		path string
+		want string
+	}{
+		{
+			name: "regular",
+			setup: func(rootfs, outside string) error {
+				return ioutil.WriteFile(filepath.Join(rootfs, "etc", "hosts"), []byte(base), 0644)
+			},
+			path: "etc/hosts",
+			want: updated,
+		},
+		{
+			name: "replace entries",
+			setup: func(rootfs, outside string) error {
+				return ioutil.WriteFile(filepath.Join(rootfs, "etc", "hosts"), []byte(base+hostsMarker+"\n10.88.0.2\told\n"), 0644)
+			},
+			path: "etc/hosts",
+			want: updated,
+		},
+		{
+			name: "hard link kept",
+			setup: func(rootfs, outside string) error {
+				object := filepath.Join(outside, "object")
+				if err := ioutil.WriteFile(object, []byte(base), 0644); err != nil {
+					return err
+				}
+				return os.Link(object, filepath.Join(rootfs, "etc", "hosts"))
+			},
+			path: "etc/hosts",
+			want: updated,
+		},
+		{
+			name: "absolute symlink in scope",
+			setup: func(rootfs, outside string) error {
+				if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "hosts.real"), []byte(base), 0644); err != nil {
+					return err
+				}
+				return os.Symlink("/etc/hosts.real", filepath.Join(rootfs, "etc", "hosts"))
+			},
+			path: "etc/hosts.real",
+			want: updated,
+		},
+		{
+			name: "symlink to host",
+			setup: func(rootfs, outside string) error {
+				if err := os.RemoveAll(filepath.Join(rootfs, "etc")); err != nil {
+					return err
+				}
+				return os.Symlink(outside, filepath.Join(rootfs, "etc"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "directory",
+			setup: func(rootfs, outside string) error {
+				return os.Mkdir(filepath.Join(rootfs, "etc", "hosts"), 0755)
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bodman-hosts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			rootfs, outside := filepath.Join(dir, "rootfs"), filepath.Join(dir, "outside")
+			for _, d := range []string{filepath.Join(rootfs, "etc"), outside} {
+				if err := os.MkdirAll(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hostHosts := filepath.Join(outside, "hosts")
+			if err := ioutil.WriteFile(hostHosts, []byte(base), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.setup(rootfs, outside); err != nil {
+				t.Fatal(err)
+			}
+
+			err = updateHostsFile(rootfs, lines)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			// Nothing outside of rootfs may change.
+			for _, name := range []string{"hosts", "object"} {
+				content, err := ioutil.ReadFile(filepath.Join(outside, name))
+				if err == nil && string(content) != base {
+					t.Errorf("%s outside of rootfs changed: %q", name, content)
+				}
+			}
+			if tc.wantErr {
+				return
+			}
+			content, err := ioutil.ReadFile(filepath.Join(rootfs, tc.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tc.want {
+				t.Errorf("got %q, want %q", content, tc.want)
+			}
+		})
+	}
+}
+
+func TestHostsRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bodman-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := &hostsRegistry{Networks: map[string]map[string]*hostsEntry{"bodman": {}}}
+	for _, m := range []struct {
+		id, ip string
+		// locked is whether the container runs.
+		locked bool
+	}{
+		{id: "web", ip: "10.88.0.2", locked: true},
+		{id: "db", ip: "10.88.0.3", locked: true},
+		{id: "exited", ip: "10.88.0.4"},
+		{id: "removed", ip: "10.88.0.5"},
+	} {
+		e := &hostsEntry{
+			Names:  []string{m.id},
+			IP:     m.ip,
+			Rootfs: filepath.Join(dir, m.id, "rootfs"),
+			Dir:    filepath.Join(dir, m.id),
+		}
+		r.Networks["bodman"][m.id] = e
+		if m.id == "removed" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(e.Rootfs, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(e.Rootfs, "etc", "hosts"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !m.locked {
+			continue
+		}
+		l, err := os.Open(e.Dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if err := unix.Flock(int(l.Fd()), unix.LOCK_EX); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Entries recorded without the directory are kept.
+	r.Networks["bodman"]["old"] = &hostsEntry{Names: []string{"old"}, IP: "10.88.0.6"}
+
+	r.refresh()
+	for id, want := range map[string]string{
+		"web":    hostsMarker + "\n10.88.0.3\tdb\n10.88.0.6\told\n",
+		"db":     hostsMarker + "\n10.88.0.2\tweb\n10.88.0.6\told\n",
+		"exited": "",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, id, "rootfs", "etc", "hosts"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("%s: got %q, want %q", id, content, want)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/google/uuid"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	netnsDir = "/var/run/netns"
+	// Default directories of libcni and host-local. Containers created
+	// before the cache moved into the container directory used the cache.
+	cniCacheDir      = "/var/lib/cni"
+	hostLocalDataDir = "/var/lib/cni/networks"
+)
+
+// Leak is a resource of a container which is gone.
+type Leak struct {
+	Description string
+	Remove      func() error
+}
+
+// FindLeaks finds the network resources of containers and pods whose ID is
+// not in known, which are left behind by containers removed by hand. The
+// directories are shared with other runtimes, so only IDs in the format of
+// bodman are considered, and namespaces still used by a process are kept.
+// Leaked CNI networks are deleted with the config in cniConfigDir and the
+// plugins in cniPluginDir, unless the config is cached.
+func FindLeaks(base string, known map[string]bool, cniConfigDir string, cniPluginDir []string) ([]*Leak, error) {
+	dirs := cniLeakDirs{
+		netns:     netnsDir,
+		cache:     cniCacheDir,
+		hostLocal: hostLocalDataDir,
+		config:    cniConfigDir,
+		plugins:   cniPluginDir,
+	}
+	var leaks []*Leak
+	for _, find := range []func(map[string]bool) ([]*Leak, error){
+		func(known map[string]bool) ([]*Leak, error) {
+			return findCNILeaks(dirs, known)
+		},
+		findVethLeaks,
+		func(known map[string]bool) ([]*Leak, error) {
+			return findBridgeIPAMLeaks(getBridgeStateFile(base), known)
+		},
+		func(known map[string]bool) ([]*Leak, error) {
+			return findHostsLeaks(base, known)
+		},
+	} {
+		l, err := find(known)
+		if err != nil {
+			return nil, err
+		}
+		leaks = append(leaks, l...)
+	}
+	return leaks, nil
+}
+
+// isLeaked reports whether id is a container or pod ID of bodman, which are
+// UUIDs in their canonical form, and is not known. Other runtimes use 64 hex
+// digits.
+func isLeaked(id string, known map[string]bool) bool {
+	if u, err := uuid.Parse(id); err != nil || u.String() != id {
+		return false
+	}
+	return !known[id]
+}
+
+// usedNetNS returns the inodes of network namespaces of all processes.
+func usedNetNS() map[uint64]bool {
+	used := make(map[uint64]bool)
+	paths, _ := filepath.Glob("/proc/[0-9]*/task/[0-9]*/ns/net")
+	for _, p := range paths {
+		if ino := nsInode(p); ino != 0 {
+			used[ino] = true
+		}
+	}
+	return used
+}
+
+func nsInode(path string) uint64 {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0
+	}
+	return st.Ino
+}
+
+// deleteNetNS unmounts and removes the network namespace bound at path.
+func deleteNetNS(path string) error {
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cniLeakDirs are the directories the CNI state of containers is found in,
+// and the ones to delete their networks with.
+type cniLeakDirs struct {
+	netns     string
+	cache     string
+	hostLocal string
+	config    string
+	plugins   []string
+}
+
+// cniAttachment is a CNI network a leaked container was attached to, found
+// by the files libcni and host-local keep for it.
+type cniAttachment struct {
+	network string
+	ifName  string
+	files   []string
+}
+
+// findCNIAttachments finds the cached results of libcni and the addresses
+// reserved by host-local of leaked containers, by container ID. The cache of
+// containers created after it moved into the container directory is gone
+// with the directory, so reservations are matched by their container ID. A
+// cached result only counts if it was attached to the netns bodman names
+// after the container.
+func findCNIAttachments(dirs cniLeakDirs, known map[string]bool) (map[string][]*cniAttachment, error) {
+	attachments := make(map[string][]*cniAttachment)
+	add := func(id, network, ifName, path string) {
+		for _, a := range attachments[id] {
+			if a.network == network && a.ifName == ifName {
+				a.files = append(a.files, path)
+				return
+			}
+		}
+		attachments[id] = append(attachments[id], &cniAttachment{network: network, ifName: ifName, files: []string{path}})
+	}
+
+	resultsDir := filepath.Join(dirs.cache, "results")
+	results, err := ioutil.ReadDir(resultsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("List cni cache failed: %w", err)
+	}
+	for _, r := range results {
+		path := filepath.Join(resultsDir, r.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var cached struct {
+			ContainerID string `json:"containerId"`
+			NetworkName string `json:"networkName"`
+			IfName      string `json:"ifName"`
+			Result      struct {
+				Interfaces []struct {
+					Sandbox string `json:"sandbox"`
+				} `json:"interfaces"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(content, &cached); err != nil || !isLeaked(cached.ContainerID, known) {
+			continue
+		}
+		ns := filepath.Join(dirs.netns, getNetNS(cached.ContainerID))
+		for _, i := range cached.Result.Interfaces {
+			if i.Sandbox == ns {
+				add(cached.ContainerID, cached.NetworkName, cached.IfName, path)
+				break
+			}
+		}
+	}
+
+	networks, err := ioutil.ReadDir(dirs.hostLocal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("List host-local reservations failed: %w", err)
+	}
+	for _, n := range networks {
+		dir := filepath.Join(dirs.hostLocal, n.Name())
+		reservations, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, r := range reservations {
+			if r.Name() == "lock" || strings.HasPrefix(r.Name(), "last_reserved_ip") {
+				continue
+			}
+			path := filepath.Join(dir, r.Name())
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			// The first line is the container ID, followed by the interface.
+			lines := strings.SplitN(string(content), "\n", 3)
+			id, ifName := strings.TrimSpace(lines[0]), ""
+			if len(lines) > 1 {
+				ifName = strings.TrimSpace(lines[1])
+			}
+			if !isLeaked(id, known) {
+				continue
+			}
+			add(id, n.Name(), ifName, path)
+		}
+	}
+	return attachments, nil
+}
+
+// findCNILeaks finds the network namespaces of leaked containers and the CNI
+// networks attached to them. The networks are deleted before the namespace,
+// so plugins clean up what they set up in and for it, like portmap rules,
+// and the namespace is kept if that fails. Namespaces still used by a
+// process are kept with their networks.
+func findCNILeaks(dirs cniLeakDirs, known map[string]bool) ([]*Leak, error) {
+	attachments, err := findCNIAttachments(dirs, known)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	for id := range attachments {
+		ids[id] = true
+	}
+	entries, err := ioutil.ReadDir(dirs.netns)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("List netns failed: %w", err)
+	}
+	for _, e := range entries {
+		if id := strings.TrimPrefix(e.Name(), "cni-"); id != e.Name() && isLeaked(id, known) {
+			ids[id] = true
+		}
+	}
+	var sorted []string
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	inUse := usedNetNS()
+	var leaks []*Leak
+	for _, id := range sorted {
+		id := id
+		ns := filepath.Join(dirs.netns, getNetNS(id))
+		exists := true
+		if _, err := os.Lstat(ns); os.IsNotExist(err) {
+			exists = false
+		} else if inUse[nsInode(ns)] {
+			continue
+		}
+		failed := false
+		for _, a := range attachments[id] {
+			a, netnsPath := a, ns
+			if !exists {
+				netnsPath = ""
+			}
+			leaks = append(leaks, &Leak{
+				Description: fmt.Sprintf("cni network %s of %s", a.network, id),
+				Remove: func() error {
+					if err := a.remove(dirs, id, netnsPath); err != nil {
+						failed = true
+						return err
+					}
+					return nil
+				},
+			})
+		}
+		if !exists {
+			continue
+		}
+		leaks = append(leaks, &Leak{
+			Description: "netns " + getNetNS(id),
+			Remove: func() error {
+				if failed {
+					return fmt.Errorf("Networks attached to it are not deleted")
+				}
+				return deleteNetNS(ns)
+			},
+		})
+	}
+	return leaks, nil
+}
+
+// remove deletes the network with the config cached by libcni, or the one in
+// the config directory, and removes the files left of it. Without any config
+// the network can't be deleted, so only the files are removed.
+func (a *cniAttachment) remove(dirs cniLeakDirs, id, netnsPath string) error {
+	rt := newRuntimeConfig(id, a.ifName, "")
+	rt.NetNS = netnsPath
+	n := &Network{
+		NetworkName:   a.network,
+		RuntimeConfig: rt,
+		CNIConfigDir:  dirs.config,
+		CNIPluginDir:  dirs.plugins,
+		CNICacheDir:   dirs.cache,
+	}
+	cninet := libcni.NewCNIConfigWithCacheDir(n.CNIPluginDir, n.CNICacheDir, nil)
+	if netconf, rt, err := n.loadConfList(cninet); err == nil {
+		if err := cninet.DelNetworkList(context.TODO(), netconf, rt); err != nil {
+			return fmt.Errorf("Delete cni network %s failed: %w", a.network, err)
+		}
+	}
+	for _, f := range a.files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// findVethLeaks finds veth attached to the native bridge, whose netns is kept
+// alive by something else.
+func findVethLeaks(known map[string]bool) ([]*Leak, error) {
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return nil, nil
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("List links failed: %w", err)
+	}
+	used := make(map[string]bool)
+	for id := range known {
+		hostName, _ := bridgeVethNames(id)
+		used[hostName] = true
+	}
+	var leaks []*Leak
+	for _, link := range links {
+		link := link
+		if link.Attrs().MasterIndex != br.Attrs().Index || used[link.Attrs().Name] {
+			continue
+		}
+		leaks = append(leaks, &Leak{
+			Description: "veth " + link.Attrs().Name,
+			Remove:      func() error { return netlink.LinkDel(link) },
+		})
+	}
+	return leaks, nil
+}
+
+func findBridgeIPAMLeaks(path string, known map[string]bool) ([]*Leak, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ipam bridgeIPAM
+	if err := json.Unmarshal(content, &ipam); err != nil {
+		return nil, fmt.Errorf("Parse %s failed: %w", path, err)
+	}
+	var ips []string
+	for ip, id := range ipam.Allocations {
+		if !known[id] {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	var leaks []*Leak
+	for _, ip := range ips {
+		id := ipam.Allocations[ip]
+		leaks = append(leaks, &Leak{
+			Description: fmt.Sprintf("address %s of network %s", ip, bridgeNetworkName),
+			Remove: func() error {
+				return withBridgeIPAM(path, func(ipam *bridgeIPAM) error {
+					ipam.release(id)
+					return nil
+				})
+			},
+		})
+	}
+	return leaks, nil
+}
+
+func findHostsLeaks(base string, known map[string]bool) ([]*Leak, error) {
+	path := getHostsRegistryFile(base)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r hostsRegistry
+	if err := json.Unmarshal(content, &r); err != nil {
+		return nil, fmt.Errorf("Parse %s failed: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	var leaks []*Leak
+	for _, members := range r.Networks {
+		for id := range members {
+			if known[id] || seen[id] {
+				continue
+			}
+			seen[id] = true
+			id := id
+			leaks = append(leaks, &Leak{
+				Description: "hosts entry of " + id,
+				Remove:      func() error { return UnregisterHosts(base, id) },
+			})
+		}
+	}
+	return leaks, nil
+}
@@ -0,0 +1,204 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFindCNILeaks(t *testing.T) {
+	const (
+		leaked  = "0b6a2a7e-57c1-4b7e-9d4a-3f0e8a1c2d01"
+		running = "5f1c9e3a-8d2b-4c6f-a1e7-9b0d3c4e5f02"
+		foreign = "9a8b7c6d5e4f4a3b8c2d1e0f9a8b7c039a8b7c6d5e4f4a3b8c2d1e0f9a8b7c03"
+	)
+	cached := func(id, network, sandbox string) string {
+		return fmt.Sprintf(`{"kind":"cniCacheV1","containerId":%q,"networkName":%q,"ifName":"eth0","result":{"cniVersion":"0.4.0","interfaces":[{"name":"cni0"},{"name":"eth0","sandbox":%q}]}}`, id, network, sandbox)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		results      func(netnsDir string) map[string]string
+		reservations map[string]string
+		netns        []string
+		// removed are the files removed, sorted.
+		removed []string
+		// dels are the DEL commands run by the plugin.
+		dels []string
+	}{
+		{
+			name: "cached result",
+			results: func(netnsDir string) map[string]string {
+				return map[string]string{
+					"net1-" + leaked + "-eth0": cached(leaked, "net1", filepath.Join(netnsDir, getNetNS(leaked))),
+				}
+			},
+			reservations: map[string]string{
+				"net1/10.89.0.2":          leaked + "\neth0",
+				"net1/last_reserved_ip.0": "10.89.0.2",
+				"net1/lock":               "",
+			},
+			removed: []string{"networks/net1/10.89.0.2", "results/net1-" + leaked + "-eth0"},
+			// The netns is gone already.
+			dels: []string{"DEL " + leaked + " eth0 none"},
+		},
+		{
+			// The cache lived in the container directory removed by
+			// hand, and the container exited without its netns
+			// being removed.
+			name: "removed container dir",
+			reservations: map[string]string{
+				"net1/10.89.0.3": leaked + "\neth0",
+				"net2/10.90.0.3": leaked + "\neth1",
+			},
+			netns:   []string{getNetNS(leaked)},
+			removed: []string{"netns/" + getNetNS(leaked), "networks/net1/10.89.0.3", "networks/net2/10.90.0.3"},
+			dels: []string{
+				"DEL " + leaked + " eth0 present",
+				"DEL " + leaked + " eth1 present",
+			},
+		},
+		{
+			name:    "netns only",
+			netns:   []string{getNetNS(leaked)},
+			removed: []string{"netns/" + getNetNS(leaked)},
+		},
+		{
+			name: "known",
+			results: func(netnsDir string) map[string]string {
+				return map[string]string{
+					"net1-" + running + "-eth0": cached(running, "net1", filepath.Join(netnsDir, getNetNS(running))),
+				}
+			},
+			reservations: map[string]string{
+				"net1/10.89.0.4": running + "\neth0",
+			},
+			netns: []string{getNetNS(running)},
+		},
+		{
+			name: "other runtime",
+			results: func(netnsDir string) map[string]string {
+				return map[string]string{
+					"net1-" + foreign + "-eth0": cached(foreign, "net1", "/proc/4242/ns/net"),
+				}
+			},
+			reservations: map[string]string{
+				"net1/10.89.0.5": foreign + "\neth0",
+			},
+		},
+		{
+			name: "result of other netns",
+			results: func(netnsDir string) map[string]string {
+				return map[string]string{
+					"net1-" + leaked + "-eth0": cached(leaked, "net1", "/proc/4242/ns/net"),
+				}
+			},
+		},
+		{
+			name: "not an id",
+			reservations: map[string]string{
+				"net1/10.89.0.6": "abc\neth0",
+				"net1/10.89.0.7": strings.ToUpper(leaked) + "\neth0",
+			},
+			netns: []string{"cni-abc", "other"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bodman-leaks")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			dirs := cniLeakDirs{
+				netns:     filepath.Join(dir, "netns"),
+				cache:     filepath.Join(dir, "cache"),
+				hostLocal: filepath.Join(dir, "networks"),
+				config:    filepath.Join(dir, "net.d"),
+				plugins:   []string{filepath.Join(dir, "bin")},
+			}
+			write := func(path, content string, perm os.FileMode) {
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(content), perm); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The plugin logs the DEL commands, and whether the netns
+			// still exists.
+			log := filepath.Join(dir, "log")
+			write(filepath.Join(dirs.plugins[0], "fake"), fmt.Sprintf(`#!/bin/sh
+ns=none
+[ -n "$CNI_NETNS" ] && [ -e "$CNI_NETNS" ] && ns=present
+echo "$CNI_COMMAND $CNI_CONTAINERID $CNI_IFNAME $ns" >> %s
+`, log), 0755)
+			for _, n := range []string{"net1", "net2"} {
+				write(filepath.Join(dirs.config, n+".conflist"), fmt.Sprintf(`{"cniVersion":"0.3.1","name":%q,"plugins":[{"type":"fake"}]}`, n), 0644)
+			}
+			var results map[string]string
+			if tc.results != nil {
+				results = tc.results(dirs.netns)
+			}
+			for name, content := range results {
+				write(filepath.Join(dirs.cache, "results", name), content, 0644)
+			}
+			for name, content := range tc.reservations {
+				write(filepath.Join(dirs.hostLocal, name), content, 0644)
+			}
+			for _, name := range tc.netns {
+				write(filepath.Join(dirs.netns, name), "", 0644)
+			}
+
+			leaks, err := findCNILeaks(dirs, map[string]bool{running: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range leaks {
+				if err := l.Remove(); err != nil {
+					t.Fatalf("Remove %s: %v", l.Description, err)
+				}
+			}
+			var removed []string
+			for prefix, names := range map[string][]string{
+				"results/":  keys(results),
+				"networks/": keys(tc.reservations),
+				"netns/":    tc.netns,
+			} {
+				for _, name := range names {
+					path := filepath.Join(dir, prefix, name)
+					if prefix == "results/" {
+						path = filepath.Join(dirs.cache, "results", name)
+					}
+					if _, err := os.Stat(path); os.IsNotExist(err) {
+						removed = append(removed, prefix+name)
+					}
+				}
+			}
+			sort.Strings(removed)
+			if !reflect.DeepEqual(removed, tc.removed) {
+				t.Errorf("removed %q, want %q", removed, tc.removed)
+			}
+			var dels []string
+			if content, err := ioutil.ReadFile(log); err == nil {
+				dels = strings.Split(strings.TrimSpace(string(content)), "\n")
+			}
+			sort.Strings(dels)
+			if !reflect.DeepEqual(dels, tc.dels) {
+				t.Errorf("got %q, want %q", dels, tc.dels)
+			}
+		})
+	}
+}
+
+func keys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -1,14 +1,21 @@
 package network
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/urfave/cli/v2"
+	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
 
@@ -22,74 +29,273 @@ type Network struct {
 	CNIConfigDir     string
 	CNIPluginDir     []string
 	NetworkNamespace string
+	// CNICacheDir is where libcni caches the config and result of adding
+	// the network.
+	CNICacheDir string
+	// Result is the result of adding the CNI network, available after
+	// Execute.
+	Result *current.Result `json:",omitempty"`
+	// PortMappings are the published ports with host ports allocated.
+	PortMappings []PortMapping `json:",omitempty"`
+	// BridgeStateFile is the address allocation state of the native bridge
+	// network.
+	BridgeStateFile string `json:",omitempty"`
+	// NamespacePath is the network namespace joined by container: and ns:
+	// networks.
+	NamespacePath string `json:",omitempty"`
 }
 
-func NewNetwork(ctx *cli.Context, hostname, containerID string) (*Network, error) {
-	networkNamespace := fmt.Sprintf("cni-%s", containerID)
-	cniArgs := [][2]string{
-		{"IgnoreUnknown", "1"},
-		{"K8S_POD_NAME", hostname},
-		{"K8S_POD_NAMESPACE", networkNamespace},
-		{"K8S_POD_INFRA_CONTAINER_ID", containerID},
+const (
+	containerNetworkPrefix = "container:"
+	nsNetworkPrefix        = "ns:"
+	podNetworkPrefix       = "pod:"
+)
+
+// NewPodNetworks creates the network config of a container joining the
+// network namespace at path of a pod.
+func NewPodNetworks(pod, path string) Networks {
+	return Networks{{
+		NetworkName:   podNetworkPrefix + pod,
+		NamespacePath: path,
+	}}
+}
+
+// IsJoined reports whether the network joins an existing network namespace
+// instead of creating one.
+func (n *Network) IsJoined() bool {
+	for _, prefix := range []string{containerNetworkPrefix, nsNetworkPrefix, podNetworkPrefix} {
+		if strings.HasPrefix(n.NetworkName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinedContainer returns the container whose network namespace is joined by
+// a container: network.
+func (n *Network) JoinedContainer() string {
+	if !strings.HasPrefix(n.NetworkName, containerNetworkPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(n.NetworkName, containerNetworkPrefix)
+}
+
+// managed reports whether the network namespace is created and set up by
+// the network.
+func (n *Network) managed() bool {
+	return n.NetworkName != "host" && n.NetworkName != "none" && !n.IsJoined()
+}
+
+// ownsNamespace reports whether the network namespace is created for the
+// container, which is the case for none as well.
+func (n *Network) ownsNamespace() bool {
+	return n.NetworkName != "host" && !n.IsJoined()
+}
+
+// Networks are the network attachments of a container. All attachments share
+// the network namespace of the container. The first one is the primary
+// network, published ports and static addresses apply to it.
+type Networks []*Network
+
+// SplitNetworks splits the values of --network on commas, which the flag
+// parser doesn't, and drops empty names.
+func SplitNetworks(values []string) []string {
+	var names []string
+	for _, v := range values {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
 	}
-	capabilityArgs := make(map[string]interface{})
+	return names
+}
+
+// NewNetworks creates the network config of a container. exposedPorts are the
+// ports exposed by the image, published if --publish-all is set.
+func NewNetworks(ctx *cli.Context, hostname, containerID, cacheDir string, exposedPorts map[string]struct{}) (Networks, error) {
+	names := SplitNetworks(ctx.StringSlice("network"))
+	if len(names) == 0 {
+		names = []string{"host"}
+	}
+	var networks Networks
+	seen := make(map[string]bool)
+	for i, name := range names {
+		n := newNetwork(ctx, name, fmt.Sprintf("eth%d", i), hostname, containerID, cacheDir)
+		if !n.managed() && len(names) > 1 {
+			return nil, fmt.Errorf("Network %s can't be combined with other networks", name)
+		}
+		if strings.HasPrefix(name, nsNetworkPrefix) {
+			n.NamespacePath = strings.TrimPrefix(name, nsNetworkPrefix)
+			if _, err := os.Stat(n.NamespacePath); err != nil {
+				return nil, fmt.Errorf("Invalid network namespace: %w", err)
+			}
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Network %s is given more than once", name)
+		}
+		seen[name] = true
+		networks = append(networks, n)
+	}
+	primary := networks[0]
 
 	portMappings, err := createPortBindings(ctx.StringSlice("publish"))
 	if err != nil {
 		return nil, err
 	}
+	if ctx.Bool("publish-all") {
+		exposed, err := exposedPortBindings(exposedPorts, portMappings)
+		if err != nil {
+			return nil, err
+		}
+		portMappings = append(portMappings, exposed...)
+	}
 	if len(portMappings) > 0 {
-		capabilityArgs["portMappings"] = portMappings
+		if !primary.managed() {
+			return nil, fmt.Errorf("Publishing ports needs a cni network, not %s", primary.NetworkName)
+		}
+		if err := allocateHostPorts(portMappings); err != nil {
+			return nil, err
+		}
+		primary.RuntimeConfig.CapabilityArgs["portMappings"] = portMappings
+		primary.PortMappings = portMappings
+	}
+	ips, mac, err := parseStaticAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) > 0 {
+		var s []string
+		for _, ip := range ips {
+			s = append(s, ip.String())
+		}
+		primary.RuntimeConfig.CapabilityArgs["ips"] = s
+	}
+	if mac != nil {
+		primary.RuntimeConfig.CapabilityArgs["mac"] = mac.String()
+	}
+	if err := primary.validateStaticAddresses(ips, mac); err != nil {
+		return nil, err
 	}
+	capabilityArgs, err := parseCapabilityArgs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dns := make(map[string][]string)
+	if servers := ctx.StringSlice("dns"); len(servers) > 0 && !(len(servers) == 1 && servers[0] == "none") {
+		dns["servers"] = servers
+	}
+	if search := ctx.StringSlice("dns-search"); len(search) > 0 {
+		dns["searches"] = search
+	}
+	if options := ctx.StringSlice("dns-option"); len(options) > 0 {
+		dns["options"] = options
+	}
+	if err := primary.applyCapabilityArgs(capabilityArgs, dns, ctx.StringSlice("network-alias")); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
 
+func newNetwork(ctx *cli.Context, name, ifName, hostname, containerID, cacheDir string) *Network {
 	return &Network{
-		NetworkName: ctx.String("network"),
-		RuntimeConfig: &libcni.RuntimeConf{
-			ContainerID:    containerID,
-			NetNS:          filepath.Join("/var/run/netns", networkNamespace),
-			IfName:         "eth0",
-			Args:           cniArgs,
-			CapabilityArgs: capabilityArgs,
-		},
+		NetworkName:      name,
+		RuntimeConfig:    newRuntimeConfig(containerID, ifName, hostname),
 		CNIConfigDir:     ctx.String("cni-config-dir"),
 		CNIPluginDir:     ctx.StringSlice("cni-plugin-dir"),
-		NetworkNamespace: networkNamespace,
-	}, nil
+		CNICacheDir:      cacheDir,
+		NetworkNamespace: getNetNS(containerID),
+		BridgeStateFile:  getBridgeStateFile(ctx.String("base-directory")),
+	}
 }
 
-func Load(path string) (*Network, error) {
-	f, err := os.Open(path)
+func newRuntimeConfig(containerID, ifName, hostname string) *libcni.RuntimeConf {
+	networkNamespace := getNetNS(containerID)
+	cniArgs := [][2]string{
+		{"IgnoreUnknown", "1"},
+		{"K8S_POD_NAME", hostname},
+		{"K8S_POD_NAMESPACE", networkNamespace},
+		{"K8S_POD_INFRA_CONTAINER_ID", containerID},
+	}
+	return &libcni.RuntimeConf{
+		ContainerID:    containerID,
+		NetNS:          filepath.Join("/var/run/netns", networkNamespace),
+		IfName:         ifName,
+		Args:           cniArgs,
+		CapabilityArgs: make(map[string]interface{}),
+	}
+}
+
+// Load loads the networks of a container. A single network is accepted as
+// well, which is how containers created before multiple networks were
+// supported recorded their network.
+func Load(path string) (Networks, error) {
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	var n Network
-	if err := json.NewDecoder(f).Decode(&n); err != nil {
+	var networks Networks
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '{' {
+		var n Network
+		if err := json.Unmarshal(content, &n); err != nil {
+			return nil, err
+		}
+		return Networks{&n}, nil
+	}
+	if err := json.Unmarshal(content, &networks); err != nil {
 		return nil, err
 	}
-	return &n, nil
+	return networks, nil
 }
 
-func Dump(path string, n *Network) error {
+func Dump(path string, networks Networks) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if err := json.NewEncoder(f).Encode(n); err != nil {
+	if err := json.NewEncoder(f).Encode(networks); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (n *Network) Execute() error {
-	switch n.NetworkName {
-	case "host":
+// NamespacePath returns the path of the network namespace, which others can
+// join. The host network namespace is the one of init.
+func (networks Networks) NamespacePath() (string, error) {
+	if len(networks) == 0 {
+		return "", fmt.Errorf("No network")
+	}
+	n := networks[0]
+	switch {
+	case n.NetworkName == "host":
+		return "/proc/1/ns/net", nil
+	case n.IsJoined():
+		return n.NamespacePath, nil
+	default:
+		return n.RuntimeConfig.NetNS, nil
+	}
+}
+
+// Execute creates the network namespace and attaches all networks to it. The
+// current thread is moved into the namespace.
+func (networks Networks) Execute() error {
+	if len(networks) == 0 {
 		return nil
-	case "none":
-		if _, err := netns.New(); err != nil {
-			return err
-		}
+	}
+	switch n := networks[0]; {
+	case n.NetworkName == "host":
 		return nil
+	case n.IsJoined():
+		if n.NamespacePath == "" {
+			return fmt.Errorf("Network namespace of %s is not resolved", n.NetworkName)
+		}
+		ns, err := netns.GetFromPath(n.NamespacePath)
+		if err != nil {
+			return fmt.Errorf("Open netns %s failed: %w", n.NamespacePath, err)
+		}
+		defer ns.Close()
+		return netns.Set(ns)
 	default:
 		// Save current network namespace
 		oldNS, err := netns.Get()
@@ -98,46 +304,271 @@ func (n *Network) Execute() error {
 		}
 		defer oldNS.Close()
 		// Create new network namespace
-		newNS, err := netns.NewNamed(n.NetworkNamespace)
+		newNS, err := netns.NewNamed(networks[0].NetworkNamespace)
 		if err != nil {
 			return fmt.Errorf("Create new netns failed: %w", err)
 		}
 		defer newNS.Close()
-		// Back to old network namspace to load CNI plugin
+		if err := setupLoopback(newNS); err != nil {
+			return err
+		}
+		// Back to old network namspace to run CNI plugins and create links
 		if err := netns.Set(oldNS); err != nil {
 			return fmt.Errorf("Back to old netns failed: %w", err)
 		}
-		// Add CNI Network
+		// Networks can't be combined with none, which has nothing to attach.
+		for _, n := range networks {
+			if !n.managed() {
+				continue
+			}
+			if err := n.attach(newNS); err != nil {
+				return fmt.Errorf("Attach network %s failed: %w", n.NetworkName, err)
+			}
+		}
+		// New namespace is ready for Use
+		return netns.Set(newNS)
+	}
+}
+
+// setupLoopback brings up lo, which is down in a new network namespace.
+func setupLoopback(ns netns.NsHandle) error {
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("Get netlink handle failed: %w", err)
+	}
+	defer h.Delete()
+	lo, err := h.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("Find loopback failed: %w", err)
+	}
+	if err := h.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("Bring up loopback failed: %w", err)
+	}
+	return nil
+}
+
+func (n *Network) attach(ns netns.NsHandle) error {
+	var err error
+	switch n.NetworkName {
+	case bridgeNetworkName:
+		if n.Result, err = n.setupBridge(ns); err != nil {
+			return fmt.Errorf("Setup bridge network failed: %w", err)
+		}
+		return nil
+	default:
 		netconf, err := libcni.LoadConfList(n.CNIConfigDir, n.NetworkName)
 		if err != nil {
 			return fmt.Errorf("Load cni config failed: %w", err)
 		}
-
-		cninet := libcni.NewCNIConfig(n.CNIPluginDir, nil)
-		if _, err := cninet.AddNetworkList(context.TODO(), netconf, n.RuntimeConfig); err != nil {
+		cninet := libcni.NewCNIConfigWithCacheDir(n.CNIPluginDir, n.CNICacheDir, nil)
+		result, err := cninet.AddNetworkList(context.TODO(), netconf, n.RuntimeConfig)
+		if err != nil {
 			return fmt.Errorf("Add cni network failed: %w", err)
 		}
-		// New namespace is ready for Use
-		return netns.Set(newNS)
+		if n.Result, err = current.NewResultFromResult(result); err != nil {
+			return fmt.Errorf("Convert cni result failed: %w", err)
+		}
+		return nil
+	}
+}
+
+// NeedsPortForwarder reports whether published ports must be forwarded in
+// userspace, since plugins silently ignore capability args they don't
+// declare.
+func (n *Network) NeedsPortForwarder() (bool, error) {
+	if len(n.PortMappings) == 0 {
+		return false, nil
+	}
+	if n.NetworkName == bridgeNetworkName {
+		return true, nil
+	}
+	netconf, err := libcni.LoadConfList(n.CNIConfigDir, n.NetworkName)
+	if err != nil {
+		return false, fmt.Errorf("Load cni config failed: %w", err)
+	}
+	return !hasCapability(netconf, "portMappings"), nil
+}
+
+// ContainerIP returns the address of the container, preferring IPv4. It
+// returns nil if the network has no result or no address.
+func (n *Network) ContainerIP() net.IP {
+	if n.Result == nil {
+		return nil
+	}
+	var ip net.IP
+	for _, c := range n.Result.IPs {
+		if c.Address.IP.To4() != nil {
+			return c.Address.IP
+		}
+		if ip == nil {
+			ip = c.Address.IP
+		}
+	}
+	return ip
+}
+
+func hasCapability(netconf *libcni.NetworkConfigList, capability string) bool {
+	for _, plugin := range netconf.Plugins {
+		if plugin.Network.Capabilities[capability] {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConfList loads the network config used when the network was added from
+// the libcni cache, so the network is handled the same way even if the config
+// in CNIConfigDir is changed or removed. It falls back to the config in
+// CNIConfigDir if nothing is cached.
+func (n *Network) loadConfList(cninet *libcni.CNIConfig) (*libcni.NetworkConfigList, *libcni.RuntimeConf, error) {
+	cached, rt, err := cninet.GetNetworkListCachedConfig(&libcni.NetworkConfigList{Name: n.NetworkName}, n.RuntimeConfig)
+	if err == nil && cached != nil {
+		if netconf, err := libcni.ConfListFromBytes(cached); err == nil {
+			return netconf, rt, nil
+		}
+	}
+	netconf, err := libcni.LoadConfList(n.CNIConfigDir, n.NetworkName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Load cni config failed: %w", err)
 	}
+	return netconf, n.RuntimeConfig, nil
+}
 
+// Remove detaches all networks and removes the network namespace. All steps
+// are tried even if some of them failed, the errors of failed steps are
+// returned.
+func (networks Networks) Remove() []error {
+	if len(networks) == 0 || !networks[0].ownsNamespace() {
+		// Joined namespaces are owned by someone else.
+		return nil
+	}
+	var errs []error
+	for i := len(networks) - 1; i >= 0; i-- {
+		if networks[i].managed() {
+			errs = append(errs, networks[i].detach()...)
+		}
+	}
+	namespace := networks[0].NetworkNamespace
+	if err := netns.DeleteNamed(namespace); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, fmt.Errorf("Delete netns %s failed: %w", namespace, err))
+	}
+	return errs
 }
 
-func (n *Network) Remove() error {
+func (n *Network) detach() []error {
 	switch n.NetworkName {
-	case "host":
+	case bridgeNetworkName:
+		return n.removeBridge()
+	default:
+		cninet := libcni.NewCNIConfigWithCacheDir(n.CNIPluginDir, n.CNICacheDir, nil)
+		netconf, rt, err := n.loadConfList(cninet)
+		if err != nil {
+			return []error{err}
+		}
+		if err := cninet.DelNetworkList(context.TODO(), netconf, rt); err != nil {
+			return []error{fmt.Errorf("Delete cni network %s failed: %w", n.NetworkName, err)}
+		}
 		return nil
+	}
+}
+
+// Check checks all networks, errors reported by plugins are prefixed with
+// the network name.
+func (networks Networks) Check() ([]error, error) {
+	var errs []error
+	for _, n := range networks {
+		nerrs, err := n.Check()
+		if err != nil {
+			return nil, fmt.Errorf("Check network %s failed: %w", n.NetworkName, err)
+		}
+		for _, e := range nerrs {
+			errs = append(errs, fmt.Errorf("%s: %w", n.NetworkName, e))
+		}
+	}
+	return errs, nil
+}
+
+// Names returns the names of all networks.
+func (networks Networks) Names() []string {
+	var names []string
+	for _, n := range networks {
+		names = append(names, n.NetworkName)
+	}
+	return names
+}
+
+// DNS returns the name servers and search domains reported by the networks,
+// available after Execute.
+func (networks Networks) DNS() ([]string, []string) {
+	var servers, search []string
+	for _, n := range networks {
+		if n.Result == nil {
+			continue
+		}
+		servers = append(servers, n.Result.DNS.Nameservers...)
+		if n.Result.DNS.Domain != "" {
+			search = append(search, n.Result.DNS.Domain)
+		}
+		search = append(search, n.Result.DNS.Search...)
+	}
+	return servers, search
+}
+
+// Check runs CNI CHECK of every plugin in the network against the result
+// cached when the network was added. Errors reported by plugins are returned
+// separately from errors preventing the check.
+func (n *Network) Check() ([]error, error) {
+	if n.IsJoined() {
+		if _, err := os.Stat(n.NamespacePath); err != nil {
+			return []error{fmt.Errorf("Joined netns is gone: %w", err)}, nil
+		}
+		return nil, nil
+	}
+	switch n.NetworkName {
+	case "host":
+		return nil, nil
 	case "none":
-		return nil
+		if _, err := os.Stat(n.RuntimeConfig.NetNS); err != nil {
+			return []error{fmt.Errorf("Netns is gone: %w", err)}, nil
+		}
+		return nil, nil
+	case bridgeNetworkName:
+		return n.checkBridge(), nil
 	default:
-		netconf, err := libcni.LoadConfList(n.CNIConfigDir, n.NetworkName)
+		cninet := libcni.NewCNIConfigWithCacheDir(n.CNIPluginDir, n.CNICacheDir, nil)
+		netconf, rt, err := n.loadConfList(cninet)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		cninet := libcni.NewCNIConfig(n.CNIPluginDir, nil)
-		if err := cninet.DelNetworkList(context.TODO(), netconf, n.RuntimeConfig); err != nil {
-			return err
+		if gtet, err := version.GreaterThanOrEqualTo(netconf.CNIVersion, "0.4.0"); err != nil {
+			return nil, err
+		} else if !gtet {
+			return nil, fmt.Errorf("Configuration version %q does not support the CHECK command", netconf.CNIVersion)
+		}
+		if netconf.DisableCheck {
+			return nil, nil
+		}
+		result, err := cninet.GetNetworkListCachedResult(netconf, rt)
+		if err != nil {
+			return nil, fmt.Errorf("Get cached cni result failed: %w", err)
+		}
+		if result == nil {
+			return nil, fmt.Errorf("No cached cni result found in %s", n.CNICacheDir)
+		}
+		// Check plugins one by one so every broken plugin is reported.
+		var errs []error
+		for _, plugin := range netconf.Plugins {
+			conf, err := libcni.InjectConf(plugin, map[string]interface{}{
+				"name":       netconf.Name,
+				"cniVersion": netconf.CNIVersion,
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err := cninet.CheckNetwork(context.TODO(), conf, rt); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", plugin.Network.Type, err))
+			}
 		}
-		return netns.DeleteNamed(n.NetworkNamespace)
+		return errs, nil
 	}
 }
@@ -0,0 +1,25 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitNetworks(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   []string
+	}{
+		{values: nil, want: nil},
+		{values: []string{"bodman"}, want: []string{"bodman"}},
+		{values: []string{"a,b"}, want: []string{"a", "b"}},
+		{values: []string{"a", "b,c"}, want: []string{"a", "b", "c"}},
+		{values: []string{"a,,b,"}, want: []string{"a", "b"}},
+		{values: []string{" a , b "}, want: []string{"a", "b"}},
+		{values: []string{",", ""}, want: nil},
+	} {
+		if got := SplitNetworks(tc.values); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("SplitNetworks(%q) = %q, want %q", tc.values, got, tc.want)
+		}
+	}
+}
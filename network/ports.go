@@ -2,7 +2,9 @@ package network
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -103,6 +105,35 @@ func createPortBindings(ports []string) ([]PortMapping, error) {
 	return toReturn, nil
 }
 
+// exposedPortBindings maps the exposed ports of an image, formatted as
+// port[/protocol], to random host ports. Ports already in published are
+// skipped.
+func exposedPortBindings(exposedPorts map[string]struct{}, published []PortMapping) ([]PortMapping, error) {
+	ports := make([]string, 0, len(exposedPorts))
+	for p := range exposedPorts {
+		ports = append(ports, p)
+	}
+	sort.Strings(ports)
+	var toReturn []PortMapping
+	for _, p := range ports {
+		// An empty host port is allocated randomly.
+		mappings, err := createPortBindings([]string{":" + p})
+		if err != nil {
+			return nil, fmt.Errorf("invalid exposed port %q: %w", p, err)
+		}
+	next:
+		for _, m := range mappings {
+			for _, pub := range published {
+				if pub.ContainerPort == m.ContainerPort && pub.Protocol == m.Protocol {
+					continue next
+				}
+			}
+			toReturn = append(toReturn, m)
+		}
+	}
+	return toReturn, nil
+}
+
 // parseSplitPort parses individual components of the --publish flag to produce
 // a single port mapping in SpecGen format.
 func parseSplitPort(hostIP, hostPort *string, ctrPort string, protocol *string) ([]PortMapping, error) {
@@ -116,11 +147,12 @@ func parseSplitPort(hostIP, hostPort *string, ctrPort string, protocol *string)
 	}
 	basePort.ContainerPort = ctrStart
 
-	if protocol != nil {
-		basePort.Protocol = *protocol
-		if basePort.Protocol == "" {
-			basePort.Protocol = "tcp"
-		}
+	basePort.Protocol = protoTCP
+	if protocol != nil && *protocol != "" {
+		basePort.Protocol = strings.ToLower(*protocol)
+	}
+	if basePort.Protocol != protoTCP && basePort.Protocol != protoUDP {
+		return nil, fmt.Errorf("unsupported protocol %q - must be tcp or udp", basePort.Protocol)
 	}
 
 	if hostIP != nil {
@@ -139,8 +171,8 @@ func parseSplitPort(hostIP, hostPort *string, ctrPort string, protocol *string)
 
 	if hostPort != nil {
 		if *hostPort == "" {
-			// Set 0 as a placeholder. The server side of Specgen
-			// will find a random, open, unused port to use.
+			// Set 0 as a placeholder. allocateHostPorts will find
+			// a random, open, unused port to use.
 			basePort.HostPort = 0
 		} else {
 			hostStart, hostLen, err := parseAndValidateRange(*hostPort)
@@ -217,3 +249,49 @@ func parseAndValidatePort(port string) (int32, error) {
 	}
 	return int32(num), nil
 }
+
+// allocateHostPorts replaces host ports of 0 by free ports on the host. The
+// ports are found by binding them, so they are distinct from each other but
+// may be taken by someone else before the network is set up.
+func allocateHostPorts(mappings []PortMapping) error {
+	var listeners []io.Closer
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for i := range mappings {
+		m := &mappings[i]
+		if m.HostPort != 0 {
+			continue
+		}
+		addr := net.JoinHostPort(m.HostIP, "0")
+		switch m.Protocol {
+		case protoTCP:
+			l, err := net.Listen(protoTCP, addr)
+			if err != nil {
+				return fmt.Errorf("Allocate host port for %d/%s failed: %w", m.ContainerPort, m.Protocol, err)
+			}
+			listeners = append(listeners, l)
+			m.HostPort = int32(l.Addr().(*net.TCPAddr).Port)
+		case protoUDP:
+			l, err := net.ListenPacket(protoUDP, addr)
+			if err != nil {
+				return fmt.Errorf("Allocate host port for %d/%s failed: %w", m.ContainerPort, m.Protocol, err)
+			}
+			listeners = append(listeners, l)
+			m.HostPort = int32(l.LocalAddr().(*net.UDPAddr).Port)
+		default:
+			return fmt.Errorf("Unsupported protocol %s", m.Protocol)
+		}
+	}
+	return nil
+}
+
+func (p PortMapping) String() string {
+	hostIP := p.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%d/%s -> %s", p.ContainerPort, p.Protocol, net.JoinHostPort(hostIP, strconv.Itoa(int(p.HostPort))))
+}
@@ -0,0 +1,62 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExposedPortBindings(t *testing.T) {
+	exposed := map[string]struct{}{
+		"80/tcp":    {},
+		"53/udp":    {},
+		"53/tcp":    {},
+		"9000-9002": {},
+	}
+	// 80/tcp and 9001/tcp are already published with -p, 53 is only
+	// published for tcp.
+	published, err := createPortBindings([]string{"8080:80", "9001:9001", "53:53/tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := exposedPortBindings(exposed, published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PortMapping{
+		{ContainerPort: 53, Protocol: "udp"},
+		{ContainerPort: 9000, Protocol: "tcp"},
+		{ContainerPort: 9002, Protocol: "tcp"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	all := append(append([]PortMapping{}, published...), got...)
+	if err := allocateHostPorts(all); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range all[:len(published)] {
+		if m != published[i] {
+			t.Errorf("published mapping changed to %v", m)
+		}
+	}
+	seen := make(map[PortMapping]bool)
+	for _, m := range all[len(published):] {
+		if m.HostPort == 0 {
+			t.Errorf("no host port allocated for %v", m)
+		}
+		key := PortMapping{HostPort: m.HostPort, Protocol: m.Protocol}
+		if seen[key] {
+			t.Errorf("host port of %v allocated twice", m)
+		}
+		seen[key] = true
+	}
+}
+
+func TestExposedPortBindingsInvalid(t *testing.T) {
+	for _, p := range []string{"http", "80/sctp", "0", "70000/tcp", "9002-9000"} {
+		if got, err := exposedPortBindings(map[string]struct{}{p: {}}, nil); err == nil {
+			t.Errorf("exposed port %q: got %+v, want error", p, got)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Package repotree reads the file tree of a commit in an ostree repository and
+// compares it with a directory. The otbuiltin bindings only cover the builtin
+// commands, so this talks to libostree directly.
+package repotree
+
+// #cgo pkg-config: ostree-1
+// #include <stdlib.h>
+// #include <glib.h>
+// #include <ostree.h>
+// #include "repotree.go.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"unsafe"
+)
+
+// FileInfo is the metadata of a file in a commit. Uid, Gid, Mode and Xattrs
+// are the ones recorded in the commit, not the ones of the objects on disk,
+// which are owned by the repository owner in bare-user repositories. Mode is a
+// st_mode including the file type.
+type FileInfo struct {
+	Mode     uint32
+	Uid      uint32
+	Gid      uint32
+	Size     int64
+	Xattrs   map[string][]byte
+	Target   string
+	Checksum string
+}
+
+// ReadTree returns the files under subpath of commit, keyed by their path
+// relative to subpath with a leading slash. subpath itself is not included.
+func ReadTree(repoPath, commit, subpath string) (map[string]*FileInfo, error) {
+	dir, release, err := openCommitDir(repoPath, commit, subpath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	tree := make(map[string]*FileInfo)
+	if err := walk(dir, "/", tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// DiffOptions tweaks how the files of a directory are compared with a commit.
+type DiffOptions struct {
+	// OwnerUid and OwnerGid replace the owner of the files of the directory
+	// if not -1.
+	OwnerUid int
+	OwnerGid int
+	// IgnoreXattrs compares files without their extended attributes.
+	IgnoreXattrs bool
+}
+
+// Changes are the paths reported by ostree_diff_dirs, relative to the compared
+// directories with a leading slash.
+type Changes struct {
+	Modified []string
+	Removed  []string
+	Added    []string
+}
+
+// Diff compares subpath of commit with dir using ostree_diff_dirs.
+func Diff(repoPath, commit, subpath, dir string, opts DiffOptions) (*Changes, error) {
+	a, release, err := openCommitDir(repoPath, commit, subpath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	cdir := C.CString(dir)
+	defer C.free(unsafe.Pointer(cdir))
+	b := C.g_file_new_for_path(cdir)
+	defer C.g_object_unref(C.gpointer(b))
+
+	var flags C.OstreeDiffFlags = C.OSTREE_DIFF_FLAGS_NONE
+	if opts.IgnoreXattrs {
+		flags = C.OSTREE_DIFF_FLAGS_IGNORE_XATTRS
+	}
+	modified, removed, added := C._diff_item_array_new(), C._file_array_new(), C._file_array_new()
+	defer C.g_ptr_array_unref(modified)
+	defer C.g_ptr_array_unref(removed)
+	defer C.g_ptr_array_unref(added)
+	var cerr *C.GError
+	if C._ostree_diff_dirs(flags, a, b, modified, removed, added, C.gint(opts.OwnerUid), C.gint(opts.OwnerGid), &cerr) == C.FALSE {
+		return nil, convertError(cerr)
+	}
+
+	changes := &Changes{}
+	for _, item := range ptrArray(modified) {
+		changes.Modified = append(changes.Modified, relativePath(a, (*C.OstreeDiffItem)(item).src))
+	}
+	for _, file := range ptrArray(removed) {
+		changes.Removed = append(changes.Removed, relativePath(a, (*C.GFile)(file)))
+	}
+	for _, file := range ptrArray(added) {
+		changes.Added = append(changes.Added, relativePath(b, (*C.GFile)(file)))
+	}
+	return changes, nil
+}
+
+// openCommitDir opens subpath of commit. release frees it along with the
+// repository.
+func openCommitDir(repoPath, commit, subpath string) (*C.GFile, func(), error) {
+	cpath := C.CString(repoPath)
+	defer C.free(unsafe.Pointer(cpath))
+	repoFile := C.g_file_new_for_path(cpath)
+	defer C.g_object_unref(C.gpointer(repoFile))
+	repo := C.ostree_repo_new(repoFile)
+
+	var cerr *C.GError
+	if C.ostree_repo_open(repo, nil, &cerr) == C.FALSE {
+		C.g_object_unref(C.gpointer(repo))
+		return nil, nil, convertError(cerr)
+	}
+
+	ccommit := C.CString(commit)
+	defer C.free(unsafe.Pointer(ccommit))
+	var root *C.GFile
+	if C.ostree_repo_read_commit(repo, ccommit, &root, nil, nil, &cerr) == C.FALSE {
+		C.g_object_unref(C.gpointer(repo))
+		return nil, nil, convertError(cerr)
+	}
+
+	csubpath := C.CString(path.Clean("/" + subpath)[1:])
+	defer C.free(unsafe.Pointer(csubpath))
+	dir := root
+	if *csubpath != 0 {
+		dir = C.g_file_resolve_relative_path(root, csubpath)
+	}
+	return dir, func() {
+		if dir != root {
+			C.g_object_unref(C.gpointer(dir))
+		}
+		C.g_object_unref(C.gpointer(root))
+		C.g_object_unref(C.gpointer(repo))
+	}, nil
+}
+
+func ptrArray(arr *C.GPtrArray) []unsafe.Pointer {
+	if arr.len == 0 {
+		return nil
+	}
+	return (*[1 << 28]unsafe.Pointer)(unsafe.Pointer(arr.pdata))[:arr.len:arr.len]
+}
+
+func relativePath(parent, file *C.GFile) string {
+	rel := C.g_file_get_relative_path(parent, file)
+	if rel == nil {
+		return "/"
+	}
+	defer C.g_free(C.gpointer(rel))
+	return filepath.Join("/", C.GoString(rel))
+}
+
+func walk(dir *C.GFile, rel string, tree map[string]*FileInfo) error {
+	var cerr *C.GError
+	enum := C.g_file_enumerate_children(dir, C._ostree_queryinfo(), C.G_FILE_QUERY_INFO_NOFOLLOW_SYMLINKS, nil, &cerr)
+	if enum == nil {
+		return convertError(cerr)
+	}
+	defer C.g_object_unref(C.gpointer(enum))
+	for {
+		info := C.g_file_enumerator_next_file(enum, nil, &cerr)
+		if info == nil {
+			if cerr != nil {
+				return convertError(cerr)
+			}
+			return nil
+		}
+		child := C.g_file_enumerator_get_child(enum, info)
+		err := addFile(child, info, rel, tree)
+		C.g_object_unref(C.gpointer(child))
+		C.g_object_unref(C.gpointer(info))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func addFile(file *C.GFile, info *C.GFileInfo, rel string, tree map[string]*FileInfo) error {
+	p := filepath.Join(rel, C.GoString(C.g_file_info_get_name(info)))
+	fi := &FileInfo{
+		Mode: uint32(C._file_info_get_mode(info)),
+		Uid:  uint32(C._file_info_get_uid(info)),
+		Gid:  uint32(C._file_info_get_gid(info)),
+		Size: int64(C.g_file_info_get_size(info)),
+	}
+	xattrs, err := readXattrs(file)
+	if err != nil {
+		return fmt.Errorf("Read xattrs of %s failed: %w", p, err)
+	}
+	fi.Xattrs = xattrs
+	tree[p] = fi
+	switch C.g_file_info_get_file_type(info) {
+	case C.G_FILE_TYPE_DIRECTORY:
+		return walk(file, p, tree)
+	case C.G_FILE_TYPE_SYMBOLIC_LINK:
+		fi.Target = C.GoString(C.g_file_info_get_symlink_target(info))
+	case C.G_FILE_TYPE_REGULAR:
+		fi.Checksum = C.GoString(C.ostree_repo_file_get_checksum(C._ostree_repo_file(file)))
+	}
+	return nil
+}
+
+func readXattrs(file *C.GFile) (map[string][]byte, error) {
+	var xattrs *C.GVariant
+	var cerr *C.GError
+	if C._ostree_repo_file_get_xattrs(file, &xattrs, &cerr) == C.FALSE {
+		return nil, convertError(cerr)
+	}
+	if xattrs == nil {
+		return nil, nil
+	}
+	defer C.g_variant_unref(xattrs)
+	n := C.g_variant_n_children(xattrs)
+	if n == 0 {
+		return nil, nil
+	}
+	out := make(map[string][]byte, int(n))
+	for i := C.gsize(0); i < n; i++ {
+		var name *C.char
+		value := C._xattr_get(xattrs, i, &name)
+		var size C.gsize
+		data := C.g_variant_get_fixed_array(value, &size, 1)
+		out[C.GoString(name)] = C.GoBytes(data, C.int(size))
+		C.g_variant_unref(value)
+	}
+	return out, nil
+}
+
+// ObjectPath returns the path of the content object with checksum in a bare
+// or bare-user repository. Files checked out with hardlinks share its inode.
+func ObjectPath(repoPath, checksum string) string {
+	if len(checksum) < 2 {
+		return ""
+	}
+	return filepath.Join(repoPath, "objects", checksum[:2], checksum[2:]+".file")
+}
+
+func convertError(cerr *C.GError) error {
+	if cerr == nil {
+		return errors.New("unknown ostree error")
+	}
+	defer C.g_error_free(cerr)
+	return fmt.Errorf("%s", C.GoString((*C.char)(cerr.message)))
+}
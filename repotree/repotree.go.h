@@ -0,0 +1,78 @@
+#ifndef REPOTREE_GO_H
+#define REPOTREE_GO_H
+
+#include <glib.h>
+#include <ostree.h>
+
+// Wrappers for macros, which CGO can't use.
+static const char*
+_ostree_queryinfo ()
+{
+  return OSTREE_GIO_FAST_QUERYINFO;
+}
+
+static OstreeRepoFile*
+_ostree_repo_file (GFile *file)
+{
+  return OSTREE_REPO_FILE (file);
+}
+
+static guint32
+_file_info_get_uid (GFileInfo *info)
+{
+  return g_file_info_get_attribute_uint32 (info, "unix::uid");
+}
+
+static guint32
+_file_info_get_gid (GFileInfo *info)
+{
+  return g_file_info_get_attribute_uint32 (info, "unix::gid");
+}
+
+static guint32
+_file_info_get_mode (GFileInfo *info)
+{
+  return g_file_info_get_attribute_uint32 (info, "unix::mode");
+}
+
+static gboolean
+_ostree_repo_file_get_xattrs (GFile *file, GVariant **out_xattrs, GError **error)
+{
+  return ostree_repo_file_get_xattrs (OSTREE_REPO_FILE (file), out_xattrs, NULL, error);
+}
+
+// _xattr_get returns the value of the i-th entry of an a(ayay) xattrs
+// variant, which must be unreffed, and points name into the variant.
+static GVariant*
+_xattr_get (GVariant *xattrs, gsize i, const char **name)
+{
+  GVariant *value;
+  g_variant_get_child (xattrs, i, "(^&ay@ay)", name, &value);
+  return value;
+}
+
+static GPtrArray*
+_diff_item_array_new ()
+{
+  return g_ptr_array_new_with_free_func ((GDestroyNotify) ostree_diff_item_unref);
+}
+
+static GPtrArray*
+_file_array_new ()
+{
+  return g_ptr_array_new_with_free_func (g_object_unref);
+}
+
+static gboolean
+_ostree_diff_dirs (OstreeDiffFlags flags, GFile *a, GFile *b,
+                   GPtrArray *modified, GPtrArray *removed, GPtrArray *added,
+                   gint owner_uid, gint owner_gid, GError **error)
+{
+  OstreeDiffDirsOptions options = OSTREE_DIFF_DIRS_OPTIONS_INIT;
+  options.owner_uid = owner_uid;
+  options.owner_gid = owner_gid;
+  return ostree_diff_dirs_with_options (flags, a, b, modified, removed, added,
+                                        &options, NULL, error);
+}
+
+#endif
@@ -0,0 +1,135 @@
+package repotree
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newTestCommit commits a small rootfs to a new bare-user repository with the
+// ostree command line and checks it out in user mode, the way images and
+// containers are laid out.
+func newTestCommit(t *testing.T, dir string) (repo, commit, checkout string) {
+	if _, err := exec.LookPath("ostree"); err != nil {
+		t.Skip("ostree is not installed")
+	}
+	ostree := func(args ...string) string {
+		out, err := exec.Command("ostree", args...).Output()
+		if err != nil {
+			t.Fatalf("ostree %s: %v", strings.Join(args, " "), err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	src := filepath.Join(dir, "src")
+	for path, content := range map[string]string{
+		"rootfs/etc/passwd":   "root:x:0:0::/root:/bin/sh\n",
+		"rootfs/etc/hosts":    "127.0.0.1 localhost\n",
+		"rootfs/usr/bin/true": "#!/bin/sh\n",
+	} {
+		path = filepath.Join(src, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("usr/bin", filepath.Join(src, "rootfs", "bin")); err != nil {
+		t.Fatal(err)
+	}
+	repo, checkout = filepath.Join(dir, "repo"), filepath.Join(dir, "checkout")
+	ostree("--repo="+repo, "init", "--mode=bare-user")
+	commit = ostree("--repo="+repo, "commit", "--branch=test", "--owner-uid=0", "--owner-gid=0", "--tree=dir="+src)
+	ostree("--repo="+repo, "checkout", "--user-mode", "--require-hardlinks", commit, checkout)
+	return repo, commit, checkout
+}
+
+func TestDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bodman-repotree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo, commit, checkout := newTestCommit(t, dir)
+	rootfs := filepath.Join(checkout, "rootfs")
+	opts := DiffOptions{OwnerUid: 0, OwnerGid: 0, IgnoreXattrs: true}
+
+	changes, err := Diff(repo, commit, "/rootfs", rootfs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes, &Changes{}) {
+		t.Errorf("fresh checkout: got %+v, want no changes", changes)
+	}
+
+	// Replace rather than write through the hardlink, which would modify
+	// the object in the repository.
+	passwd := filepath.Join(rootfs, "etc", "passwd")
+	if err := os.Remove(passwd); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(passwd, []byte("root:x:0:0::/root:/bin/bash\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(rootfs, "etc", "hosts")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(rootfs, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "data", "db"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err = Diff(repo, commit, "/rootfs", rootfs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(changes.Added)
+	want := &Changes{
+		Modified: []string{"/etc/passwd"},
+		Removed:  []string{"/etc/hosts"},
+		Added:    []string{"/data", "/data/db"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %+v, want %+v", changes, want)
+	}
+}
+
+func TestReadTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bodman-repotree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo, commit, _ := newTestCommit(t, dir)
+
+	tree, err := ReadTree(repo, commit, "/rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for p := range tree {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	want := []string{"/bin", "/etc", "/etc/hosts", "/etc/passwd", "/usr", "/usr/bin", "/usr/bin/true"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %q, want %q", paths, want)
+	}
+	if bin := tree["/bin"]; bin.Target != "usr/bin" {
+		t.Errorf("/bin points to %q", bin.Target)
+	}
+	passwd := tree["/etc/passwd"]
+	if passwd.Uid != 0 || passwd.Gid != 0 || passwd.Mode != 0100644 || passwd.Checksum == "" {
+		t.Errorf("/etc/passwd: got %+v", passwd)
+	}
+	if _, err := os.Stat(ObjectPath(repo, passwd.Checksum)); err != nil {
+		t.Errorf("object of /etc/passwd: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/fancl20/bodman/network"
+	"github.com/urfave/cli/v2"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	hostResolvConfPath = "/etc/resolv.conf"
+	// systemd-resolved lists the upstream servers behind its stub resolver
+	// here.
+	systemdResolvConfPath = "/run/systemd/resolve/resolv.conf"
+)
+
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+type resolvConf struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+}
+
+func parseResolvConf(path string) (*resolvConf, error) {
+	rc := &resolvConf{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return rc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			rc.Nameservers = append(rc.Nameservers, fields[1])
+		case "domain":
+			rc.Search = []string{fields[1]}
+		case "search":
+			rc.Search = fields[1:]
+		case "options":
+			rc.Options = append(rc.Options, fields[1:]...)
+		}
+	}
+	return rc, scanner.Err()
+}
+
+func filterLocalhost(servers []string) []string {
+	var filtered []string
+	for _, s := range servers {
+		if ip := net.ParseIP(s); ip != nil && ip.IsLoopback() {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	return filtered
+}
+
+// hostResolvConf returns the DNS config of the host read from path. Localhost
+// resolvers are unreachable from another network namespace, so they are
+// replaced by the servers in upstreamPath if filterLocal is set.
+func hostResolvConf(path, upstreamPath string, filterLocal bool) (*resolvConf, error) {
+	rc, err := parseResolvConf(path)
+	if err != nil {
+		return nil, err
+	}
+	if !filterLocal {
+		return rc, nil
+	}
+	servers := filterLocalhost(rc.Nameservers)
+	if len(servers) == 0 && len(rc.Nameservers) > 0 {
+		upstream, err := parseResolvConf(upstreamPath)
+		if err != nil {
+			return nil, err
+		}
+		servers = filterLocalhost(upstream.Nameservers)
+	}
+	rc.Nameservers = servers
+	return rc, nil
+}
+
+// inNetNS reports whether the current thread is in the network namespace ns.
+// Namespaces are compared by inode, since the one of a joined container or
+// an ns: path may be the host one as well.
+func inNetNS(ns netns.NsHandle) (bool, error) {
+	cur, err := netns.Get()
+	if err != nil {
+		return false, err
+	}
+	defer cur.Close()
+	return cur.Equal(ns), nil
+}
+
+// containerResolvConf returns the DNS config of a container on networks, run
+// in the network namespace of the current thread. Flags override the host
+// config, and servers and search domains reported by CNI plugins come before
+// the ones of the host. It returns nil for --dns none.
+func containerResolvConf(ctx *cli.Context, networks network.Networks, hostNetNS netns.NsHandle) (*resolvConf, error) {
+	dns := ctx.StringSlice("dns")
+	if len(dns) == 1 && dns[0] == "none" {
+		return nil, nil
+	}
+	inHost, err := inNetNS(hostNetNS)
+	if err != nil {
+		return nil, fmt.Errorf("Get network namespace failed: %w", err)
+	}
+	host, err := hostResolvConf(hostResolvConfPath, systemdResolvConfPath, !inHost)
+	if err != nil {
+		return nil, err
+	}
+	return mergeResolvConf(ctx, host, networks), nil
+}
+
+func mergeResolvConf(ctx *cli.Context, host *resolvConf, networks network.Networks) *resolvConf {
+	servers, search := networks.DNS()
+	return &resolvConf{
+		Nameservers: stringSliceDefault(ctx.StringSlice("dns"), dedupe(append(servers, host.Nameservers...)), defaultNameservers),
+		Search:      stringSliceDefault(ctx.StringSlice("dns-search"), dedupe(append(search, host.Search...))),
+		Options:     stringSliceDefault(ctx.StringSlice("dns-option"), host.Options),
+	}
+}
+
+func dedupe(ss []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
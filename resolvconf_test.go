@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/fancl20/bodman/network"
+	"github.com/urfave/cli/v2"
+	"github.com/vishvananda/netns"
+)
+
+func writeResolvConf(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bodman-resolvconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeResolvConf(t, dir, "resolv.conf", `# This is /run/systemd/resolve/stub-resolv.conf
+; managed by systemd-resolved
+nameserver 127.0.0.53
+nameserver
+search corp.example.com example.com
+domain ignored.example
+search corp.example.com
+options edns0 trust-ad
+options ndots:2
+sortlist 10.0.0.0/255.0.0.0
+`)
+	got, err := parseResolvConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &resolvConf{
+		Nameservers: []string{"127.0.0.53"},
+		// The last search or domain line wins, as in resolv.conf(5).
+		Search:  []string{"corp.example.com"},
+		Options: []string{"edns0", "trust-ad", "ndots:2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A host without resolv.conf has an empty config.
+	got, err = parseResolvConf(filepath.Join(dir, "missing"))
+	if err != nil || !reflect.DeepEqual(got, &resolvConf{}) {
+		t.Errorf("missing file: got %+v, %v", got, err)
+	}
+}
+
+func TestHostResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bodman-resolvconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stub := writeResolvConf(t, dir, "stub", "nameserver 127.0.0.53\nsearch corp.example.com\n")
+	mixed := writeResolvConf(t, dir, "mixed", "nameserver ::1\nnameserver 127.0.1.1\nnameserver 192.168.1.1\n")
+	upstream := writeResolvConf(t, dir, "upstream", "nameserver 10.1.0.1\nnameserver fd00::53\nsearch upstream.example\n")
+	loopbackOnly := writeResolvConf(t, dir, "loopback", "nameserver 127.0.0.1\n")
+	missing := filepath.Join(dir, "missing")
+
+	for _, tc := range []struct {
+		name           string
+		path, upstream string
+		filterLocal    bool
+		want           *resolvConf
+	}{
+		{
+			// In the host netns the stub resolver is reachable.
+			name: "host netns keeps stub", path: stub, upstream: upstream,
+			want: &resolvConf{Nameservers: []string{"127.0.0.53"}, Search: []string{"corp.example.com"}},
+		},
+		{
+			// Only the servers are taken from systemd-resolved, the
+			// search domains stay the ones of the host.
+			name: "stub replaced by upstream", path: stub, upstream: upstream, filterLocal: true,
+			want: &resolvConf{Nameservers: []string{"10.1.0.1", "fd00::53"}, Search: []string{"corp.example.com"}},
+		},
+		{
+			name: "upstream only used if nothing is left", path: mixed, upstream: upstream, filterLocal: true,
+			want: &resolvConf{Nameservers: []string{"192.168.1.1"}},
+		},
+		{
+			name: "no systemd-resolved", path: stub, upstream: missing, filterLocal: true,
+			want: &resolvConf{Search: []string{"corp.example.com"}},
+		},
+		{
+			name: "loopback upstream", path: stub, upstream: loopbackOnly, filterLocal: true,
+			want: &resolvConf{Search: []string{"corp.example.com"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := hostResolvConf(tc.path, tc.upstream, tc.filterLocal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func newDNSContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, name := range []string{"dns", "dns-option", "dns-search"} {
+		if err := (&cli.StringSliceFlag{Name: name}).Apply(set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func TestMergeResolvConf(t *testing.T) {
+	host := &resolvConf{
+		Nameservers: []string{"192.168.1.1", "10.89.0.1"},
+		Search:      []string{"corp.example.com"},
+		Options:     []string{"ndots:2"},
+	}
+	networks := network.Networks{
+		{Result: &current.Result{DNS: types.DNS{Nameservers: []string{"10.89.0.1"}, Domain: "dns.bodman", Search: []string{"corp.example.com"}}}},
+		{Result: &current.Result{DNS: types.DNS{Nameservers: []string{"10.90.0.1"}}}},
+		// Not added yet, e.g. a joined netns.
+		{},
+	}
+
+	// CNI servers and domains come first and duplicates of the host are
+	// dropped.
+	got := mergeResolvConf(newDNSContext(t), host, networks)
+	want := &resolvConf{
+		Nameservers: []string{"10.89.0.1", "10.90.0.1", "192.168.1.1"},
+		Search:      []string{"dns.bodman", "corp.example.com"},
+		Options:     []string{"ndots:2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Flags replace the merged values.
+	got = mergeResolvConf(newDNSContext(t, "--dns", "1.1.1.1", "--dns-search", "example.org", "--dns-option", "rotate"), host, networks)
+	want = &resolvConf{Nameservers: []string{"1.1.1.1"}, Search: []string{"example.org"}, Options: []string{"rotate"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flags: got %+v, want %+v", got, want)
+	}
+
+	// Public resolvers are the last resort.
+	got = mergeResolvConf(newDNSContext(t), &resolvConf{}, nil)
+	if !reflect.DeepEqual(got.Nameservers, defaultNameservers) {
+		t.Errorf("no servers: got %q, want %q", got.Nameservers, defaultNameservers)
+	}
+}
+
+func TestContainerResolvConfNone(t *testing.T) {
+	got, err := containerResolvConf(newDNSContext(t, "--dns", "none"), nil, netns.None())
+	if err != nil || got != nil {
+		t.Errorf("got %+v, %v, want the resolv.conf of the image kept", got, err)
+	}
+}
+
+func TestInNetNS(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	host, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	// The namespace of a joined container or an ns: path is opened from
+	// another path, but is the host one if it runs on host networking.
+	byPath, err := netns.GetFromPath("/proc/self/ns/net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer byPath.Close()
+	if ok, err := inNetNS(byPath); err != nil || !ok {
+		t.Errorf("host netns opened by path: got %v, %v, want true", ok, err)
+	}
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("Create netns failed: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(host)
+	if ok, err := inNetNS(host); err != nil || ok {
+		t.Errorf("new netns: got %v, %v, want false", ok, err)
+	}
+}
@@ -10,7 +10,7 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func prepareRootfs(rootfs string, mounts []*mount.Mount) error {
+func prepareRootfs(rootfs string, mounts []*mount.Mount, devs []*devices.Device) error {
 	if err := prepareRoot(rootfs); err != nil {
 		return fmt.Errorf("Prepare root failed: %w", err)
 	}
@@ -19,7 +19,7 @@ func prepareRootfs(rootfs string, mounts []*mount.Mount) error {
 			return fmt.Errorf("Apply %+v failed: %w", m, err)
 		}
 	}
-	if err := devices.CreateDevicesFromHost(rootfs); err != nil {
+	if err := devices.CreateDevices(rootfs, devs); err != nil {
 		return fmt.Errorf("Create devices failed: %w", err)
 	}
 	if err := pivotRoot(rootfs); err != nil {
@@ -150,8 +150,8 @@ func rootfsParentMountPrivate(rootfs string) error {
 	return nil
 }
 
-func parseMounts(ctx *cli.Context) ([]*mount.Mount, error) {
-	ms := defaultMounts()
+func parseVolumes(ctx *cli.Context) ([]*mount.Mount, error) {
+	var ms []*mount.Mount
 	for _, v := range ctx.StringSlice("volume") {
 		m, err := mount.ParseVolumn(v)
 		if err != nil {
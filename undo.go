@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errAbortRollback stops a rollback when the remaining actions would act on
+// the wrong filesystem. Whatever is left behind is reclaimed by gc.
+var errAbortRollback = errors.New("remaining rollback skipped, run gc to clean up")
+
+// undoStack holds actions reverting the setup steps of a container. They are
+// run in reverse order if a later step fails.
+type undoStack []func() error
+
+func (u *undoStack) push(fn func() error) {
+	*u = append(*u, fn)
+}
+
+// rollback runs all undo actions. Failed actions are reported but don't stop
+// the remaining ones, unless they fail with errAbortRollback.
+func (u *undoStack) rollback() {
+	for i := len(*u) - 1; i >= 0; i-- {
+		if err := (*u)[i](); err != nil {
+			fmt.Fprintf(os.Stderr, "Rollback failed: %v\n", err)
+			if errors.Is(err, errAbortRollback) {
+				break
+			}
+		}
+	}
+	*u = nil
+}
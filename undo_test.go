@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestUndoStackRollback(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		errs []error
+		want []int
+	}{
+		{
+			name: "all succeed",
+			errs: []error{nil, nil, nil},
+			want: []int{2, 1, 0},
+		},
+		{
+			name: "failure continues",
+			errs: []error{nil, errors.New("failed"), nil},
+			want: []int{2, 1, 0},
+		},
+		{
+			name: "abort",
+			errs: []error{nil, fmt.Errorf("setns failed: %w", errAbortRollback), nil},
+			want: []int{2, 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var undo undoStack
+			var ran []int
+			for i, err := range tc.errs {
+				i, err := i, err
+				undo.push(func() error {
+					ran = append(ran, i)
+					return err
+				})
+			}
+			undo.rollback()
+			if !reflect.DeepEqual(ran, tc.want) {
+				t.Errorf("ran %v, want %v", ran, tc.want)
+			}
+			if len(undo) != 0 {
+				t.Errorf("%d actions left after rollback", len(undo))
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// execUser is the user to run the container process as.
+type execUser struct {
+	Name   string
+	UID    int
+	GID    int
+	Groups []int
+	Home   string
+}
+
+type passwdEntry struct {
+	Name string
+	UID  int
+	GID  int
+	Home string
+}
+
+type groupEntry struct {
+	Name    string
+	GID     int
+	Members []string
+}
+
+// parseColonFile calls fn with the fields of every entry of a passwd or group
+// file. A missing file has no entries.
+func parseColonFile(path string, fn func([]string)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
+
+func parsePasswd(path string) ([]*passwdEntry, error) {
+	var entries []*passwdEntry
+	err := parseColonFile(path, func(fields []string) {
+		if len(fields) < 6 {
+			return
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return
+		}
+		entries = append(entries, &passwdEntry{Name: fields[0], UID: uid, GID: gid, Home: fields[5]})
+	})
+	return entries, err
+}
+
+func parseGroup(path string) ([]*groupEntry, error) {
+	var entries []*groupEntry
+	err := parseColonFile(path, func(fields []string) {
+		if len(fields) < 3 {
+			return
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return
+		}
+		g := &groupEntry{Name: fields[0], GID: gid}
+		if len(fields) > 3 && fields[3] != "" {
+			g.Members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, g)
+	})
+	return entries, err
+}
+
+// lookupGroup resolves a group name or ID.
+func lookupGroup(groups []*groupEntry, s string) (int, error) {
+	for _, g := range groups {
+		if g.Name == s {
+			return g.GID, nil
+		}
+	}
+	gid, err := strconv.Atoi(s)
+	if err != nil || gid < 0 {
+		return 0, fmt.Errorf("No such group: %s", s)
+	}
+	return gid, nil
+}
+
+// resolveUser resolves USER[:GROUP] against the passwd and group files of the
+// container, like the USER instruction of images. Names must exist in the
+// files, while numeric IDs needn't. The supplementary groups are the ones
+// listing the user as a member, and groupAdd.
+func resolveUser(spec string, groupAdd []string, passwdPath, groupPath string) (*execUser, error) {
+	passwd, err := parsePasswd(passwdPath)
+	if err != nil {
+		return nil, fmt.Errorf("Parse %s failed: %w", passwdPath, err)
+	}
+	groups, err := parseGroup(groupPath)
+	if err != nil {
+		return nil, fmt.Errorf("Parse %s failed: %w", groupPath, err)
+	}
+
+	userSpec, groupSpec := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userSpec, groupSpec = spec[:i], spec[i+1:]
+	}
+	if userSpec == "" {
+		userSpec = "0"
+	}
+	var entry *passwdEntry
+	for _, p := range passwd {
+		if p.Name == userSpec {
+			entry = p
+			break
+		}
+	}
+	if entry == nil {
+		uid, err := strconv.Atoi(userSpec)
+		if err != nil || uid < 0 {
+			return nil, fmt.Errorf("No such user: %s", userSpec)
+		}
+		entry = &passwdEntry{UID: uid, Home: "/"}
+		for _, p := range passwd {
+			if p.UID == uid {
+				entry = p
+				break
+			}
+		}
+	}
+
+	u := &execUser{
+		Name:   entry.Name,
+		UID:    entry.UID,
+		GID:    entry.GID,
+		Home:   entry.Home,
+		Groups: []int{},
+	}
+	if groupSpec != "" {
+		if u.GID, err = lookupGroup(groups, groupSpec); err != nil {
+			return nil, err
+		}
+	}
+	seen := map[int]bool{u.GID: true}
+	if u.Name != "" {
+		for _, g := range groups {
+			for _, m := range g.Members {
+				if m == u.Name && !seen[g.GID] {
+					seen[g.GID] = true
+					u.Groups = append(u.Groups, g.GID)
+				}
+			}
+		}
+	}
+	for _, s := range groupAdd {
+		gid, err := lookupGroup(groups, s)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[gid] {
+			seen[gid] = true
+			u.Groups = append(u.Groups, gid)
+		}
+	}
+	return u, nil
+}
+
+// Env returns HOME and USER for the variables env doesn't define.
+func (u *execUser) Env(env []string) []string {
+	defined := make(map[string]bool)
+	for _, e := range env {
+		defined[strings.SplitN(e, "=", 2)[0]] = true
+	}
+	var out []string
+	if !defined["HOME"] && u.Home != "" {
+		out = append(out, "HOME="+u.Home)
+	}
+	if !defined["USER"] && u.Name != "" {
+		out = append(out, "USER="+u.Name)
+	}
+	return out
+}
+
+// Apply switches the credentials of the current thread to the user, which
+// are kept by exec. Groups go first, since changing them needs privileges
+// dropped by setuid. unix.Setuid and unix.Setgid are unsupported, so the
+// setres variants are used.
+func (u *execUser) Apply() error {
+	if err := unix.Setgroups(u.Groups); err != nil {
+		return fmt.Errorf("Setgroups failed: %w", err)
+	}
+	if err := unix.Setresgid(u.GID, u.GID, u.GID); err != nil {
+		return fmt.Errorf("Setgid failed: %w", err)
+	}
+	if err := unix.Setresuid(u.UID, u.UID, u.UID); err != nil {
+		return fmt.Errorf("Setuid failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	testPasswd = `root:x:0:0:root:/root:/bin/sh
+# system users
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+nginx:x:101:101:nginx:/var/cache/nginx:/sbin/nologin
+app:x:1000:1000::/home/app:/bin/sh
+2000:x:3000:3000::/home/numeric:/bin/sh
+broken:x:abc:1000::/:/bin/sh
+short:x:4000
+`
+	testGroup = `root:x:0:
+daemon:x:1:
+nginx:x:101:
+app:x:1000:
+wheel:x:10:root,app
+audio:x:29:nginx,app
+video:x:44:app
+`
+)
+
+func TestResolveUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bodman-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwd, group := filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	if err := ioutil.WriteFile(passwd, []byte(testPasswd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(group, []byte(testGroup), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		spec     string
+		groupAdd []string
+		want     execUser
+	}{
+		// USER isn't set in the image.
+		{spec: "", want: execUser{Name: "root", Home: "/root", Groups: []int{10}}},
+		{spec: "nginx", want: execUser{Name: "nginx", UID: 101, GID: 101, Home: "/var/cache/nginx", Groups: []int{29}}},
+		// USER 1000:1000 finds the passwd entry by uid for HOME and groups.
+		{spec: "1000:1000", want: execUser{Name: "app", UID: 1000, GID: 1000, Home: "/home/app", Groups: []int{10, 29, 44}}},
+		{spec: "app:audio", want: execUser{Name: "app", UID: 1000, GID: 29, Home: "/home/app", Groups: []int{10, 44}}},
+		{spec: "nginx:", want: execUser{Name: "nginx", UID: 101, GID: 101, Home: "/var/cache/nginx", Groups: []int{29}}},
+		// Numeric IDs needn't exist in the files.
+		{spec: "65534:65534", want: execUser{UID: 65534, GID: 65534, Home: "/", Groups: []int{}}},
+		// A name is looked up before an ID.
+		{spec: "2000", want: execUser{Name: "2000", UID: 3000, GID: 3000, Home: "/home/numeric", Groups: []int{}}},
+		{
+			spec:     "daemon",
+			groupAdd: []string{"video", "5000", "daemon", "44"},
+			want:     execUser{Name: "daemon", UID: 1, GID: 1, Home: "/usr/sbin", Groups: []int{44, 5000}},
+		},
+	} {
+		got, err := resolveUser(tc.spec, tc.groupAdd, passwd, group)
+		if err != nil {
+			t.Errorf("resolveUser(%q, %q): %v", tc.spec, tc.groupAdd, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("resolveUser(%q, %q) = %+v, want %+v", tc.spec, tc.groupAdd, *got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		spec     string
+		groupAdd []string
+	}{
+		{spec: "nobody"},
+		{spec: "broken"},
+		{spec: "short"},
+		{spec: "-1"},
+		{spec: "app:staff"},
+		{spec: "app:-5"},
+		{spec: "app", groupAdd: []string{"staff"}},
+	} {
+		if got, err := resolveUser(tc.spec, tc.groupAdd, passwd, group); err == nil {
+			t.Errorf("resolveUser(%q, %q) = %+v, want error", tc.spec, tc.groupAdd, got)
+		}
+	}
+}
+
+// TestResolveUserNoFiles covers minimal images, like scratch ones, without
+// /etc/passwd and /etc/group.
+func TestResolveUserNoFiles(t *testing.T) {
+	got, err := resolveUser("1000:1000", []string{"27"}, "/nonexistent/passwd", "/nonexistent/group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &execUser{UID: 1000, GID: 1000, Home: "/", Groups: []int{27}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if env := got.Env(nil); !reflect.DeepEqual(env, []string{"HOME=/"}) {
+		t.Errorf("Env() = %q, want HOME only", env)
+	}
+	if _, err := resolveUser("app", nil, "/nonexistent/passwd", "/nonexistent/group"); err == nil {
+		t.Error("name resolved without passwd")
+	}
+}
+
+func TestExecUserEnv(t *testing.T) {
+	u := &execUser{Name: "app", Home: "/home/app"}
+	for _, tc := range []struct {
+		env  []string
+		want []string
+	}{
+		{env: nil, want: []string{"HOME=/home/app", "USER=app"}},
+		// Set by the image or -e, even to an empty value.
+		{env: []string{"PATH=/bin", "HOME="}, want: []string{"USER=app"}},
+		{env: []string{"HOME=/data", "USER=me"}, want: nil},
+	} {
+		if got := u.Env(tc.env); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Env(%q) = %q, want %q", tc.env, got, tc.want)
+		}
+	}
+}